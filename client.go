@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+/*
+Client of the thin-lxcd API (see daemon.go), used by the actions given -api
+*/
+
+type apiClient struct {
+	client *http.Client
+}
+
+func newApiClient(socket string) *apiClient {
+	transport := &http.Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			return net.Dial("unix", socket)
+		},
+	}
+	return &apiClient{&http.Client{Transport: transport}}
+}
+
+//body and out are JSON, out may be nil
+func (a *apiClient) do(method string, path string, body interface{}, out interface{}) error {
+	var b []byte
+	if body != nil {
+		var err error
+		if b, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, "http://thin-lxcd" + path, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Unable to reach thin-lxcd: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		var e apiError
+		if err := json.NewDecoder(resp.Body).Decode(&e); err != nil || len(e.Error) == 0 {
+			return errors.New("thin-lxcd replied " + resp.Status)
+		}
+		return errors.New(e.Error)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func containerPath(name string) string {
+	return "/containers/" + url.PathEscape(name)
+}
+
+func (a *apiClient) list() ([]*containerInfo, error) {
+	var infos []*containerInfo
+	err := a.do("GET", "/containers", nil, &infos)
+	return infos, err
+}
+
+func (a *apiClient) create(opts createOptions) (*Container, error) {
+	info := &containerInfo{}
+	if err := a.do("POST", "/containers", opts, info); err != nil {
+		return nil, err
+	}
+	return info.Container, nil
+}
+
+func (a *apiClient) inspect(name string) (*containerInfo, error) {
+	info := &containerInfo{}
+	err := a.do("GET", containerPath(name), nil, info)
+	return info, err
+}
+
+func (a *apiClient) destroy(name string) error {
+	return a.do("DELETE", containerPath(name), nil, nil)
+}
+
+func (a *apiClient) start(name string, timeout time.Duration) error {
+	return a.do("POST", containerPath(name) + "/start?timeout=" + timeout.String(), nil, nil)
+}
+
+func (a *apiClient) stop(name string, timeout time.Duration) error {
+	return a.do("POST", containerPath(name) + "/stop?timeout=" + timeout.String(), nil, nil)
+}
+
+//closed when the stream ends
+func (a *apiClient) events(name string) (<-chan stateEvent, error) {
+	resp, err := a.client.Get("http://thin-lxcd/events?name=" + url.QueryEscape(name))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to reach thin-lxcd: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, errors.New("thin-lxcd replied " + resp.Status)
+	}
+	events := make(chan stateEvent)
+	go func() {
+		defer resp.Body.Close()
+		defer close(events)
+		decoder := json.NewDecoder(resp.Body)
+		for {
+			var e stateEvent
+			if decoder.Decode(&e) != nil {
+				return
+			}
+			events <- e
+		}
+	}()
+	return events, nil
+}
+
+func (a *apiClient) reload() error {
+	return a.do("POST", "/reload", nil, nil)
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const CONFIG_PATH = "/etc/thin-lxc.conf"
+
+const DEFAULT_BRIDGE = "lxcbr0"
+const DEFAULT_SUBNET = "10.0.3.0/24"
+const DEFAULT_GATEWAY = "10.0.3.1"
+const DEFAULT_STORAGE_DRIVER = "overlayfs"
+
+/*
+Host configuration, loaded from /etc/thin-lxc.conf. Same syntax as LXC config files:
+
+# comment
+root_path = /var/lib/thin-lxc
+bridge = lxcbr0
+*/
+
+type Config struct {
+	RootPath      string //where thin-lxc data (metadata and write layer) is kept
+	LxcPath       string //where read only layers are mounted, must be the lxc path for lxc-* commands to find containers
+	BaseContainer string //default for -b
+	ImageUrl      string //base container tarball
+	ImageMd5Url   string
+	ImagePath     string //where the base container is extracted
+	Offline       bool
+
+	Bridge  string
+	Subnet  string
+	Gateway string
+	Subnet6  string //empty: no ipv6
+	Gateway6 string //default: first address of subnet6
+	Nameservers []string //empty for the gateway
+	DnsSearch   []string //search domains
+	DnsOptions  []string //resolv.conf options e.g: ndots:2
+	HostsFile   string   //host side hosts file, thin-lxc manages a block in it
+
+	DhcpRange        string //addresses reserved for DHCP containers
+	DnsmasqDhcpHosts string //dnsmasq dhcp-hostsfile
+	DnsmasqHosts     string //dnsmasq addn-hosts
+	DnsmasqPidFile   string
+	DnsmasqLeases    string
+
+	MemoryLimit string //lxc.cgroup.memory.limit_in_bytes, empty for no limit
+	CpuShares   int    //lxc.cgroup.cpu.shares, 0 for no limit
+
+	StorageDriver string //overlayfs (ubuntu kernels < 3.18) or overlay
+	Firewall      string //auto, iptables or nftables, see firewall.go
+	ProxyMaxConns int    //connections relayed at once by a -proxy port
+	PortRange     string //host ports assigned by -p :port
+
+	TemplateDir string //user templates, see templates.go
+	ApiSocket   string //unix socket of thin-lxcd, see daemon.go
+	Runtime     string //cli or liblxc, empty for the default of the build, see runtime.go
+}
+
+var config = defaultConfig()
+
+func defaultConfig() *Config {
+	return &Config{
+		RootPath:      CONTAINERS_ROOT_PATH,
+		LxcPath:       LXC_PATH,
+		BaseContainer: BASE_CN_PATH + "/baseCN",
+		ImageUrl:      BASE_CN_URL,
+		ImageMd5Url:   BASE_CN_MD5_URL,
+		ImagePath:     BASE_CN_PATH,
+		Bridge:        DEFAULT_BRIDGE,
+		Subnet:        DEFAULT_SUBNET,
+		Gateway:       DEFAULT_GATEWAY,
+		HostsFile:     HOSTS_PATH,
+
+		DhcpRange:        DEFAULT_DHCP_RANGE,
+		DnsmasqDhcpHosts: DNSMASQ_DHCP_HOSTS,
+		DnsmasqHosts:     DNSMASQ_HOSTS,
+		DnsmasqPidFile:   DNSMASQ_PID_FILE,
+		DnsmasqLeases:    DNSMASQ_LEASES,
+		StorageDriver: DEFAULT_STORAGE_DRIVER,
+		Firewall:      FIREWALL_AUTO,
+		ProxyMaxConns: DEFAULT_PROXY_MAX_CONNS,
+		PortRange:     DEFAULT_PORT_RANGE,
+		TemplateDir:   TEMPLATE_DIR,
+		ApiSocket:     DEFAULT_API_SOCKET,
+	}
+}
+
+func (cfg *Config) set(key string, value string) error {
+	var err error
+	switch key {
+	case "root_path":
+		cfg.RootPath = value
+	case "lxc_path":
+		cfg.LxcPath = value
+	case "base":
+		cfg.BaseContainer = value
+	case "image_url":
+		cfg.ImageUrl = value
+	case "image_md5_url":
+		cfg.ImageMd5Url = value
+	case "image_path":
+		cfg.ImagePath = value
+	case "offline":
+		cfg.Offline, err = strconv.ParseBool(value)
+	case "bridge":
+		cfg.Bridge = value
+	case "subnet":
+		cfg.Subnet = value
+	case "gateway":
+		cfg.Gateway = value
+	case "subnet6":
+		cfg.Subnet6 = value
+	case "gateway6":
+		cfg.Gateway6 = value
+	case "dns":
+		cfg.Nameservers = splitList(value)
+	case "dns_search":
+		cfg.DnsSearch = splitList(value)
+	case "dns_options":
+		cfg.DnsOptions = splitList(value)
+	case "hosts_file":
+		cfg.HostsFile = value
+	case "dhcp_range":
+		cfg.DhcpRange = value
+	case "dnsmasq_dhcp_hosts":
+		cfg.DnsmasqDhcpHosts = value
+	case "dnsmasq_hosts":
+		cfg.DnsmasqHosts = value
+	case "dnsmasq_pid_file":
+		cfg.DnsmasqPidFile = value
+	case "dnsmasq_leases":
+		cfg.DnsmasqLeases = value
+	case "memory_limit":
+		cfg.MemoryLimit = value
+	case "cpu_shares":
+		cfg.CpuShares, err = strconv.Atoi(value)
+	case "storage_driver":
+		cfg.StorageDriver = value
+	case "firewall":
+		cfg.Firewall = value
+	case "proxy_max_conns":
+		cfg.ProxyMaxConns, err = strconv.Atoi(value)
+	case "port_range":
+		cfg.PortRange = value
+	case "template_dir":
+		cfg.TemplateDir = value
+	case "api_socket":
+		cfg.ApiSocket = value
+	case "runtime":
+		cfg.Runtime = value
+	default:
+		return errors.New("unknown key " + key)
+	}
+	return err
+}
+
+func (cfg *Config) validate() error {
+	if _, _, err := net.ParseCIDR(cfg.Subnet); err != nil {
+		return err
+	}
+	if net.ParseIP(cfg.Gateway) == nil {
+		return errors.New("invalid gateway " + cfg.Gateway)
+	}
+	if len(cfg.Subnet6) > 0 {
+		_, ipNet, err := net.ParseCIDR(cfg.Subnet6)
+		if err != nil || ipNet.IP.To4() != nil {
+			return errors.New("invalid ipv6 subnet " + cfg.Subnet6)
+		}
+		if len(cfg.Gateway6) == 0 {
+			gw := make(net.IP, net.IPv6len)
+			copy(gw, ipNet.IP)
+			gw[15] |= 1
+			cfg.Gateway6 = gw.String()
+		}
+		if net.ParseIP(cfg.Gateway6) == nil {
+			return errors.New("invalid ipv6 gateway " + cfg.Gateway6)
+		}
+	}
+	for _, ns := range cfg.Nameservers {
+		if net.ParseIP(ns) == nil {
+			return errors.New("invalid dns server " + ns)
+		}
+	}
+	if _, _, err := parseIpRange(cfg.DhcpRange); err != nil {
+		return err
+	}
+	if cfg.StorageDriver != "overlayfs" && cfg.StorageDriver != "overlay" {
+		return errors.New("unknown storage driver " + cfg.StorageDriver + " (overlayfs or overlay)")
+	}
+	if _, _, err := parsePortRange(cfg.PortRange); err != nil {
+		return err
+	}
+	if cfg.Firewall != FIREWALL_AUTO && cfg.Firewall != FIREWALL_IPTABLES && cfg.Firewall != FIREWALL_NFTABLES {
+		return errors.New("unknown firewall " + cfg.Firewall + " (auto, iptables or nftables)")
+	}
+	if err := validRuntime(cfg.Runtime); err != nil {
+		return err
+	}
+	return nil
+}
+
+//a missing file is fine unless mustExist (path given with -c)
+func loadConfig(path string, mustExist bool) (*Config, error) {
+	cfg := defaultConfig()
+	f, err := os.Open(path)
+	if os.IsNotExist(err) && mustExist == false {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected key = value", path, lineNum)
+		}
+		if err := cfg.set(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineNum, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	//default base follows image_path
+	if cfg.BaseContainer == BASE_CN_PATH + "/baseCN" {
+		cfg.BaseContainer = cfg.ImagePath + "/baseCN"
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+//flags explicitly given on the command line win over the config file
+func (cfg *Config) applyFlags() {
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "r":
+			cfg.RootPath = *rFlag
+		case "b":
+			cfg.BaseContainer = *bFlag
+		case "offline":
+			cfg.Offline = *offlineFlag
+		case "mem":
+			cfg.MemoryLimit = *memFlag
+		case "cpu":
+			cfg.CpuShares = *cpuFlag
+		case "dns":
+			cfg.Nameservers = splitList(*dnsFlag)
+		case "search":
+			cfg.DnsSearch = splitList(*searchFlag)
+		case "dnsopt":
+			cfg.DnsOptions = splitList(*dnsoptFlag)
+		}
+	})
+}
+
+//subnet prefix length, used for static ips: 10.0.3.0/24 -> 24
+func prefixLength(subnet string) int {
+	_, ipNet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return 24
+	}
+	ones, _ := ipNet.Mask.Size()
+	return ones
+}
+
+//10.0.3.0/24 -> 255.255.255.0
+func netmask(subnet string) string {
+	_, ipNet, err := net.ParseCIDR(subnet)
+	if err != nil || len(ipNet.Mask) != net.IPv4len {
+		return "255.255.255.0"
+	}
+	return net.IP(ipNet.Mask).String()
+}
+
+//"a, b,c" -> [a b c]
+func splitList(value string) []string {
+	list := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			list = append(list, item)
+		}
+	}
+	return list
+}
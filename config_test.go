@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func Test_loadConfig(t *testing.T) {
+	fmt.Print("Testing host configuration loading ... ")
+	cfg, err := loadConfig("/nonexistent/thin-lxc.conf", false)
+	if err != nil || cfg.RootPath != CONTAINERS_ROOT_PATH || cfg.Bridge != DEFAULT_BRIDGE {
+		failTest(t, "missing config file should give defaults", err)
+	}
+	if _, err := loadConfig("/nonexistent/thin-lxc.conf", true); err == nil {
+		failTest(t, "missing explicit config file should fail")
+	}
+
+	f, _ := ioutil.TempFile("", "thin-lxc-conf")
+	defer os.Remove(f.Name())
+	f.WriteString(`
+# comment
+root_path = /srv/containers
+image_path=/srv/images
+bridge = br0
+subnet = 192.168.10.0/23
+gateway = 192.168.10.1
+cpu_shares = 512
+storage_driver = overlay
+`)
+	f.Close()
+	cfg, err = loadConfig(f.Name(), true)
+	if err != nil {
+		failTest(t, "failed to load config", err)
+	}
+	if cfg.RootPath != "/srv/containers" || cfg.Bridge != "br0" || cfg.CpuShares != 512 || cfg.StorageDriver != "overlay" {
+		failTest(t, "config values not loaded", cfg)
+	}
+	if cfg.BaseContainer != "/srv/images/baseCN" {
+		failTest(t, "default base should follow image_path", cfg.BaseContainer)
+	}
+	if prefixLength(cfg.Subnet) != 23 {
+		failTest(t, "wrong prefix length", prefixLength(cfg.Subnet))
+	}
+
+	ioutil.WriteFile(f.Name(), []byte("bridge = br0\nunknown = 1\n"), 0644)
+	if _, err := loadConfig(f.Name(), true); err == nil {
+		failTest(t, "unknown key should fail")
+	}
+	fmt.Println("OK")
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const DEFAULT_API_SOCKET = "/run/thin-lxc.sock"
+
+/*
+thin-lxcd (thin-lxc -a daemon, or the binary named thin-lxcd): JSON HTTP API on a unix socket,
+api_socket in config, only root can connect.
+
+GET    /containers               list
+POST   /containers               create, body: createOptions (field names of the flags, see thin-lxc.go)
+GET    /containers/<name>        inspect
+DELETE /containers/<name>        destroy
+POST   /containers/<name>/start  ?timeout=30s, waits until running and its probes pass
+POST   /containers/<name>/stop   ?timeout=30s, waits until stopped
+POST   /reload
+GET    /events                   ?name=<name>, streams state changes, one JSON object per line
+
+Containers are returned as their metadata plus State, errors as {"Error": "..."}: 400 for invalid
+requests, 409 for conflicts, 500 when the host fails,
+504 when start or stop timed out. Operations on a container are serialized.
+Creates, destroys and reloads also share host state (addresses, host ports, firewall chains, dnsmasq
+and hosts files), they are serialized with each other as well.
+*/
+
+//metadata and LXC state
+type containerInfo struct {
+	*Container
+	State string
+}
+
+type apiError struct {
+	Error string
+}
+
+func containerInfos(containers []*Container) []*containerInfo {
+	infos := []*containerInfo{}
+	for _, c := range containers {
+		infos = append(infos, &containerInfo{c, c.state()})
+	}
+	return infos
+}
+
+type apiDaemon struct {
+	mutex sync.Mutex
+	locks map[string]*sync.Mutex
+	host sync.Mutex
+	watcher *stateWatcher
+}
+
+func newApiDaemon(watcher *stateWatcher) *apiDaemon {
+	return &apiDaemon{locks: make(map[string]*sync.Mutex), watcher: watcher}
+}
+
+//locks the container, returns the unlock function
+func (d *apiDaemon) lock(name string) func() {
+	d.mutex.Lock()
+	l, ok := d.locks[name]
+	if ok == false {
+		l = &sync.Mutex{}
+		d.locks[name] = l
+	}
+	d.mutex.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if v != nil {
+		json.NewEncoder(w).Encode(v)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJson(w, status, apiError{err.Error()})
+}
+
+func (d *apiDaemon) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/containers", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			d.list(w)
+		case "POST":
+			d.create(w, r)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/containers/", func(w http.ResponseWriter, r *http.Request) {
+		//<name> or <name>/<operation>
+		arr := strings.Split(strings.TrimPrefix(r.URL.Path, "/containers/"), "/")
+		if err := validateName(arr[0]); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		switch {
+		case len(arr) == 1 && r.Method == "GET":
+			d.inspect(w, arr[0])
+		case len(arr) == 1 && r.Method == "DELETE":
+			d.destroy(w, arr[0])
+		case len(arr) == 2 && arr[1] == "start" && r.Method == "POST":
+			d.start(w, r, arr[0])
+		case len(arr) == 2 && arr[1] == "stop" && r.Method == "POST":
+			d.stop(w, r, arr[0])
+		case len(arr) <= 2:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	mux.HandleFunc("/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		d.reload(w)
+	})
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		d.events(w, r)
+	})
+	return mux
+}
+
+func (d *apiDaemon) list(w http.ResponseWriter) {
+	containers, err := listAllContainers()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJson(w, http.StatusOK, containerInfos(containers))
+}
+
+func (d *apiDaemon) create(w http.ResponseWriter, r *http.Request) {
+	var opts createOptions
+	if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := opts.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	defer d.lock(opts.Name)()
+	if _, err := findContainerMetadata(opts.Name); err == nil {
+		writeJson(w, http.StatusConflict, apiError{"Container " + opts.Name + " already exists"})
+		return
+	}
+	d.host.Lock()
+	defer d.host.Unlock()
+	//request errors are answered above, these are the host's (mount, lxc, firewall, disk ...)
+	c, err := createContainer(opts)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	log.Println("Created", c.Name)
+	writeJson(w, http.StatusCreated, &containerInfo{c, c.state()})
+}
+
+func (d *apiDaemon) inspect(w http.ResponseWriter, name string) {
+	defer d.lock(name)()
+	c, err := unmarshall(name)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJson(w, http.StatusOK, &containerInfo{c, c.state()})
+}
+
+func (d *apiDaemon) destroy(w http.ResponseWriter, name string) {
+	defer d.lock(name)()
+	c, err := unmarshall(name)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if c.isRunning() {
+		writeJson(w, http.StatusConflict, apiError{"Container is running. Stop it before destroying it"})
+		return
+	}
+	d.host.Lock()
+	defer d.host.Unlock()
+	if err := destroyContainer(c); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	log.Println("Destroyed", c.Name)
+	writeJson(w, http.StatusNoContent, nil)
+}
+
+//?timeout=, DEFAULT_STATE_TIMEOUT if not given
+func requestTimeout(r *http.Request) (time.Duration, error) {
+	if t := r.URL.Query().Get("timeout"); len(t) > 0 {
+		return time.ParseDuration(t)
+	}
+	return DEFAULT_STATE_TIMEOUT, nil
+}
+
+//start or stop, then wait for the state (and the probes once running)
+func (d *apiDaemon) transition(w http.ResponseWriter, r *http.Request, name string, from string, to string, do func(*Container) error) {
+	timeout, err := requestTimeout(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	defer d.lock(name)()
+	c, err := unmarshall(name)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if state := c.state(); state != from {
+		writeJson(w, http.StatusConflict, apiError{"Container is " + state})
+		return
+	}
+	if err := do(c); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	state, err := c.waitForState(ctx, d.watcher, to)
+	if err == nil && to == C_RUNNING {
+		err = c.waitReady(ctx)
+	}
+	if err != nil && ctx.Err() != nil {
+		writeError(w, http.StatusGatewayTimeout, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJson(w, http.StatusOK, &containerInfo{c, state})
+}
+
+func (d *apiDaemon) start(w http.ResponseWriter, r *http.Request, name string) {
+	d.transition(w, r, name, C_STOPPED, C_RUNNING, (*Container).start)
+}
+
+func (d *apiDaemon) stop(w http.ResponseWriter, r *http.Request, name string) {
+	d.transition(w, r, name, C_RUNNING, C_STOPPED, (*Container).stop)
+}
+
+//until the client goes away
+func (d *apiDaemon) events(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	events := d.watcher.subscribe()
+	defer d.watcher.unsubscribe(events)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	encoder := json.NewEncoder(w)
+	for {
+		select {
+		case e := <-events:
+			if len(name) > 0 && e.Name != name {
+				continue
+			}
+			if err := encoder.Encode(e); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+//containers are locked one at a time, with the host as their firewall rules and ports are shared, then the host files are synced
+func (d *apiDaemon) reload(w http.ResponseWriter) {
+	containers, err := listAllContainers()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	warnLegacyContainers(containers)
+	for _, c := range containers {
+		unlock := d.lock(c.Name)
+		d.host.Lock()
+		if err := c.reload(); err != nil {
+			log.Println("Unable to reload", c.Name, err)
+		}
+		d.host.Unlock()
+		unlock()
+	}
+	d.host.Lock()
+	syncHosts()
+	d.host.Unlock()
+	writeJson(w, http.StatusNoContent, nil)
+}
+
+//until SIGINT or SIGTERM, the socket and partial downloads are removed on exit
+func serveApi(socket string) error {
+	//left by a daemon that didn't exit cleanly
+	if err := os.Remove(socket); err != nil && os.IsNotExist(err) == false {
+		return err
+	}
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(socket, 0600); err != nil {
+		l.Close()
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	//downloads don't exit on signals, the partial files are removed here
+	interruptExits = false
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	stopped := make(chan bool)
+	go func() {
+		<-signals
+		removeInterruptPaths()
+		close(stopped)
+		l.Close()
+	}()
+	log.Println("Listening on", socket)
+	err = http.Serve(l, newApiDaemon(watchStates(ctx)).handler())
+	os.Remove(socket)
+	select {
+	case <-stopped:
+		return nil
+	default:
+		return err
+	}
+}
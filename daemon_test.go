@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_api(t *testing.T) {
+	fmt.Print("Testing thin-lxcd API ... ")
+	root, _ := ioutil.TempDir("", "thin-lxc-api")
+	defer os.RemoveAll(root)
+	rootPath := config.RootPath
+	config.RootPath, rootsFile = root, root + "/.roots"
+	defer func() { config.RootPath, rootsFile = rootPath, ROOTS_FILE }()
+
+	web := &Container{Name: "web", Path: root + "/web", LeaseIp: "10.0.3.100", Port: 80, HostPort: 8080}
+	os.MkdirAll(web.Path, 0700)
+	if err := web.marshall(); err != nil {
+		t.Fatal(err)
+	}
+
+	socket := root + "/api.sock"
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	watcher := newStateWatcher()
+	go http.Serve(l, newApiDaemon(watcher).handler())
+	client := newApiClient(socket)
+
+	infos, err := client.list()
+	if err != nil || len(infos) != 1 || infos[0].Name != "web" || infos[0].HostPort != 8080 {
+		failTest(t, "list should return the container", infos, err)
+	}
+	if info, err := client.inspect("web"); err != nil || info.Address() != "10.0.3.100" || len(info.State) == 0 {
+		failTest(t, "inspect should return metadata and state", info, err)
+	}
+	if _, err := client.inspect("db"); err == nil || strings.Contains(err.Error(), "No container named db") == false {
+		failTest(t, "unknown container should be reported", err)
+	}
+	if err := client.destroy("db"); err == nil {
+		failTest(t, "destroying an unknown container should fail")
+	}
+	for _, name := range []string{"", ".", "..", "a b", "-web", "web/x"} {
+		if _, err := client.create(createOptions{Name: name}); err == nil || strings.Contains(err.Error(), "Invalid container name") == false {
+			failTest(t, "create with an invalid name should fail", name, err)
+		}
+	}
+	if _, err := client.create(createOptions{Name: "api", Ports: "8080"}); err == nil || strings.Contains(err.Error(), "Invalid ports") == false {
+		failTest(t, "create with invalid ports should fail", err)
+	}
+	if _, err := client.inspect("-web"); err == nil || strings.Contains(err.Error(), "Invalid container name") == false {
+		failTest(t, "invalid name in the path should fail", err)
+	}
+	//request errors, conflicts and failures on the host
+	for body, status := range map[string]int{
+		`{"Name":"api","Ports":"8080"}`: http.StatusBadRequest,
+		`{"Name":"web"}`: http.StatusConflict,
+		`{"Name":"api","Base":"` + root + `/nobase"}`: http.StatusInternalServerError,
+	} {
+		rec := httptest.NewRecorder()
+		newApiDaemon(watcher).handler().ServeHTTP(rec, httptest.NewRequest("POST", "/containers", strings.NewReader(body)))
+		if rec.Code != status {
+			failTest(t, "unexpected create status", body, rec.Code, rec.Body.String())
+		}
+	}
+
+	events, err := client.events("web")
+	if err != nil {
+		failTest(t, "unable to subscribe to events", err)
+	}
+	go func() {
+		//until the stream has subscribed
+		for i := 0; i < 50; i++ {
+			watcher.publish(stateEvent{"db", C_STOPPED, time.Now()})
+			watcher.publish(stateEvent{"web", C_STOPPED, time.Now()})
+			time.Sleep(100 * time.Millisecond)
+		}
+	}()
+	if e := <-events; e.Name != "web" || e.State != C_STOPPED {
+		failTest(t, "event of web expected", e)
+	}
+	fmt.Println("OK")
+}
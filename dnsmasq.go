@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const DNSMASQ_DHCP_HOSTS = CONTAINERS_ROOT_PATH + "/dnsmasq/dhcp-hosts"
+const DNSMASQ_HOSTS = CONTAINERS_ROOT_PATH + "/dnsmasq/hosts"
+const DNSMASQ_PID_FILE = "/run/lxc/dnsmasq.pid"
+const DNSMASQ_LEASES = "/var/lib/misc/dnsmasq.lxcbr0.leases"
+const DEFAULT_DHCP_RANGE = "10.0.3.100-10.0.3.254"
+
+/*
+dnsmasq (started by lxc-net on the bridge) integration. DHCP containers get a reserved address
+(LeaseIp) tied to their Hwaddr, written to a dhcp-hostsfile, every container name is written to an
+addn-hosts file. dnsmasq rereads both on SIGHUP. It must be started with (/etc/lxc/dnsmasq.conf,
+LXC_DHCP_CONFILE in /etc/default/lxc-net):
+
+dhcp-hostsfile=/var/lib/thin-lxc/dnsmasq/dhcp-hosts
+addn-hosts=/var/lib/thin-lxc/dnsmasq/hosts
+*/
+
+//active leases from the dnsmasq leases file: hwaddr -> ip
+func readLeases(path string) map[string]string {
+	leases := make(map[string]string)
+	f, err := os.Open(path)
+	if err != nil {
+		return leases
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		//expiry hwaddr ip hostname client-id
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 3 {
+			leases[strings.ToLower(fields[1])] = fields[2]
+		}
+	}
+	return leases
+}
+
+func ipToInt(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+func intToIp(i uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, i)
+	return ip
+}
+
+//"10.0.3.100-10.0.3.254"
+func parseIpRange(r string) (uint32, uint32, error) {
+	arr := strings.Split(r, "-")
+	if len(arr) != 2 {
+		return 0, 0, errors.New("Invalid ip range " + r)
+	}
+	first, last := net.ParseIP(strings.TrimSpace(arr[0])), net.ParseIP(strings.TrimSpace(arr[1]))
+	if first == nil || last == nil || first.To4() == nil || last.To4() == nil || ipToInt(first) > ipToInt(last) {
+		return 0, 0, errors.New("Invalid ip range " + r)
+	}
+	return ipToInt(first), ipToInt(last), nil
+}
+
+/*
+Reserve a stable address for a DHCP container: the one it currently leases if any (so reserving
+doesn't renumber running containers), else the first free one in the dhcp range
+*/
+func (c *Container) reserveLease(containers []*Container, leases map[string]string) error {
+	used := map[string]bool{c.Gateway: true}
+	for _, other := range containers {
+		if other.Name != c.Name && len(other.Address()) > 0 {
+			used[other.Address()] = true
+		}
+	}
+	for hwaddr, ip := range leases {
+		if hwaddr != strings.ToLower(c.Hwaddr) {
+			used[ip] = true
+		}
+	}
+
+	if ip, ok := leases[strings.ToLower(c.Hwaddr)]; ok && used[ip] == false {
+		c.LeaseIp = ip
+		return nil
+	}
+	first, last, err := parseIpRange(config.DhcpRange)
+	if err != nil {
+		return err
+	}
+	for i := first; i <= last; i++ {
+		if ip := intToIp(i).String(); used[ip] == false {
+			c.LeaseIp = ip
+			return nil
+		}
+	}
+	return errors.New("No free address left in " + config.DhcpRange)
+}
+
+func dnsmasqFiles(containers []*Container) (dhcpHosts string, hosts string) {
+	for _, c := range containers {
+		if c.HasStaticIp() == false && len(c.LeaseIp) > 0 {
+			dhcpHosts += c.Hwaddr + "," + c.LeaseIp + "," + c.HostName + "\n"
+		}
+	}
+	for _, entry := range hostEntries(containers) {
+		hosts += entry.Ip + " " + strings.Join(entry.Names, " ") + "\n"
+	}
+	return
+}
+
+//write the file if content changed, returns true if it did
+func writeIfChanged(path string, content string) (bool, error) {
+	if b, err := ioutil.ReadFile(path); err == nil && string(b) == content {
+		return false, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return false, err
+	}
+	return true, ioutil.WriteFile(path, []byte(content), 0644)
+}
+
+func syncDnsmasq(containers []*Container) error {
+	leases := readLeases(config.DnsmasqLeases)
+	for _, c := range containers {
+		//macvlan containers lease from the LAN
+		if c.HasVeth() == false || c.HasStaticIp() || len(c.LeaseIp) > 0 {
+			continue
+		}
+		if err := c.reserveLease(containers, leases); err != nil {
+			return err
+		}
+		if err := c.marshall(); err != nil {
+			return err
+		}
+	}
+
+	dhcpHosts, hosts := dnsmasqFiles(containers)
+	changed1, err := writeIfChanged(config.DnsmasqDhcpHosts, dhcpHosts)
+	if err != nil {
+		return err
+	}
+	changed2, err := writeIfChanged(config.DnsmasqHosts, hosts)
+	if err != nil {
+		return err
+	}
+	if changed1 || changed2 {
+		return reloadDnsmasq()
+	}
+	return nil
+}
+
+func reloadDnsmasq() error {
+	b, err := ioutil.ReadFile(config.DnsmasqPidFile)
+	if err != nil {
+		log.Println("dnsmasq not reloaded, no pid file", config.DnsmasqPidFile)
+		return nil
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return errors.New("Invalid dnsmasq pid file " + config.DnsmasqPidFile)
+	}
+	return syscall.Kill(pid, syscall.SIGHUP)
+}
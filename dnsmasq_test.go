@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func Test_reserveLease(t *testing.T) {
+	fmt.Print("Testing DHCP address reservation ... ")
+	f, _ := ioutil.TempFile("", "thin-lxc-leases")
+	defer os.Remove(f.Name())
+	f.WriteString("1700000000 00:16:3e:00:00:02 10.0.3.100 worker *\n1700000000 00:16:3e:99:99:99 10.0.3.101 foreign *\n")
+	f.Close()
+	leases := readLeases(f.Name())
+
+	web := &Container{Name: "web", HostName: "web", Ip: "10.0.3.102", Gateway: DEFAULT_GATEWAY}
+	worker := &Container{Name: "worker", HostName: "worker", Hwaddr: "00:16:3E:00:00:02", Gateway: DEFAULT_GATEWAY}
+	cron := &Container{Name: "cron", HostName: "cron", Hwaddr: "00:16:3e:00:00:03", Gateway: DEFAULT_GATEWAY}
+	containers := []*Container{web, worker, cron}
+
+	//current lease is kept
+	if err := worker.reserveLease(containers, leases); err != nil || worker.LeaseIp != "10.0.3.100" {
+		failTest(t, "current lease not kept", worker.LeaseIp, err)
+	}
+	//first free address, skipping leased and static ones
+	if err := cron.reserveLease(containers, leases); err != nil || cron.LeaseIp != "10.0.3.103" {
+		failTest(t, "wrong reserved address", cron.LeaseIp, err)
+	}
+
+	dhcpHosts, hosts := dnsmasqFiles(containers)
+	if dhcpHosts != "00:16:3E:00:00:02,10.0.3.100,worker\n00:16:3e:00:00:03,10.0.3.103,cron\n" {
+		failTest(t, "unexpected dhcp-hosts", dhcpHosts)
+	}
+	if hosts != "10.0.3.103 cron\n10.0.3.102 web\n10.0.3.100 worker\n" {
+		failTest(t, "unexpected hosts", hosts)
+	}
+	fmt.Println("OK")
+}
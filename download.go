@@ -0,0 +1,543 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/bzip2"
+	"compress/gzip"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const DOWNLOAD_RETRIES = 5
+
+//doubled after each failed attempt, variable so tests don't have to wait
+var downloadBackoff = 1 * time.Second
+
+/*
+Interrupt handling: paths registered here are removed if thin-lxc gets SIGINT/SIGTERM. The handler
+exits and is only installed while paths are registered. thin-lxcd handles the signals itself, it
+calls removeInterruptPaths before exiting.
+*/
+
+var interruptPaths = make(map[string]bool)
+var interruptMutex sync.Mutex
+var interruptSignals chan os.Signal
+
+//false in thin-lxcd
+var interruptExits = true
+
+func removeOnInterrupt(path string) {
+	interruptMutex.Lock()
+	defer interruptMutex.Unlock()
+	interruptPaths[path] = true
+	if interruptSignals != nil || interruptExits == false {
+		return
+	}
+	interruptSignals = make(chan os.Signal, 1)
+	signal.Notify(interruptSignals, syscall.SIGINT, syscall.SIGTERM)
+	go func(sigs chan os.Signal) {
+		sig, ok := <-sigs
+		if ok == false {
+			return
+		}
+		removeInterruptPaths()
+		fmt.Println("\nInterrupted (", sig, "), partial files removed")
+		os.Exit(130)
+	}(interruptSignals)
+}
+
+func keepOnInterrupt(path string) {
+	interruptMutex.Lock()
+	defer interruptMutex.Unlock()
+	delete(interruptPaths, path)
+	if len(interruptPaths) == 0 && interruptSignals != nil {
+		signal.Stop(interruptSignals)
+		close(interruptSignals)
+		interruptSignals = nil
+	}
+}
+
+func removeInterruptPaths() {
+	interruptMutex.Lock()
+	defer interruptMutex.Unlock()
+	for p := range interruptPaths {
+		os.RemoveAll(p)
+	}
+}
+
+/*
+Download
+*/
+
+type httpStatusError struct {
+	url    string
+	status int
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("GET %s: unexpected HTTP status %d %s", e.url, e.status, http.StatusText(e.status))
+}
+
+//4xx won't get better by retrying
+func (e *httpStatusError) temporary() bool {
+	return e.status >= 500 || e.status == http.StatusTooManyRequests
+}
+
+type progressWriter struct {
+	name    string
+	done    int64
+	total   int64 //-1 if unknown
+	printed time.Time
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	p.done += int64(len(b))
+	if time.Since(p.printed) > 200*time.Millisecond {
+		p.print()
+	}
+	return len(b), nil
+}
+
+func (p *progressWriter) print() {
+	p.printed = time.Now()
+	mb := float64(p.done) / (1 << 20)
+	if p.total > 0 {
+		fmt.Printf("\r%s %5.1f%% (%.1f/%.1f MB)", p.name, float64(p.done)*100/float64(p.total), mb, float64(p.total)/(1<<20))
+	} else {
+		fmt.Printf("\r%s %.1f MB", p.name, mb)
+	}
+}
+
+/*
+Download url into dest and return the md5 sum of the file. The file is first written to dest.part,
+a partial file left by a failed attempt (or a previous run) is resumed using an HTTP Range request.
+If dest already exists it is not downloaded again.
+*/
+func downloadFromUrl(url string, dest string) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(dest), 0700); err != nil {
+		return "", err
+	}
+	if fileExists(dest) {
+		return md5File(dest)
+	}
+	part := dest + ".part"
+	removeOnInterrupt(part)
+	defer keepOnInterrupt(part)
+
+	var err error
+	backoff := downloadBackoff
+	for attempt := 1; attempt <= DOWNLOAD_RETRIES; attempt++ {
+		var sum string
+		sum, err = downloadAttempt(url, part)
+		if err == nil {
+			if err = os.Rename(part, dest); err != nil {
+				return "", err
+			}
+			return sum, nil
+		}
+		if statusErr, ok := err.(*httpStatusError); ok && statusErr.temporary() == false {
+			os.Remove(part)
+			return "", err
+		}
+		if attempt < DOWNLOAD_RETRIES {
+			fmt.Printf("\nDownload failed (%v), retrying in %v (%d/%d)\n", err, backoff, attempt, DOWNLOAD_RETRIES-1)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	return "", err
+}
+
+func downloadAttempt(url string, part string) (string, error) {
+	output, err := os.OpenFile(part, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer output.Close()
+
+	//hash what we already have, the rest is hashed while streaming
+	md5 := md5.New()
+	offset, err := io.Copy(md5, output)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		//server ignored the range (or there was none), start over
+		if offset > 0 {
+			md5.Reset()
+			offset = 0
+		}
+		if err := output.Truncate(0); err != nil {
+			return "", err
+		}
+		if _, err := output.Seek(0, 0); err != nil {
+			return "", err
+		}
+	case http.StatusPartialContent:
+		if start := contentRangeStart(resp.Header.Get("Content-Range")); start != offset {
+			return "", fmt.Errorf("GET %s: asked to resume at %d, server answered from %d", url, offset, start)
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		//partial file is already complete
+		if contentRangeTotal(resp.Header.Get("Content-Range")) == offset {
+			return fmt.Sprintf("%x", md5.Sum(nil)), nil
+		}
+		output.Truncate(0)
+		return "", errors.New("GET " + url + ": partial download doesn't match remote file, restarting")
+	default:
+		return "", &httpStatusError{url, resp.StatusCode}
+	}
+
+	total := int64(-1)
+	if resp.ContentLength >= 0 {
+		total = offset + resp.ContentLength
+	}
+	progress := &progressWriter{name: filepath.Base(url), done: offset, total: total}
+	_, err = io.Copy(io.MultiWriter(output, md5, progress), resp.Body)
+	progress.print()
+	fmt.Println()
+	if err != nil {
+		return "", err
+	}
+	if total > 0 && progress.done != total {
+		return "", fmt.Errorf("GET %s: got %d bytes, expected %d", url, progress.done, total)
+	}
+	return fmt.Sprintf("%x", md5.Sum(nil)), nil
+}
+
+//"bytes 100-999/1000" -> 100
+func contentRangeStart(header string) int64 {
+	header = strings.TrimPrefix(header, "bytes ")
+	start, err := strconv.ParseInt(strings.Split(header, "-")[0], 10, 64)
+	if err != nil {
+		return -1
+	}
+	return start
+}
+
+//"bytes */1000" -> 1000
+func contentRangeTotal(header string) int64 {
+	i := strings.LastIndex(header, "/")
+	if i < 0 {
+		return -1
+	}
+	total, err := strconv.ParseInt(header[i+1:], 10, 64)
+	if err != nil {
+		return -1
+	}
+	return total
+}
+
+func fetchString(url string) (string, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", &httpStatusError{url, resp.StatusCode}
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+func md5File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return hashReader(md5.New(), f)
+}
+
+func hashReader(h hash.Hash, r io.Reader) (string, error) {
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+/*
+Extraction, equivalent of tar --numeric-owner --xattrs -xpf
+*/
+
+func extractArchive(archive string, dest string) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, err := decompressReader(bufio.NewReader(f))
+	if err != nil {
+		return err
+	}
+	return extractTar(tar.NewReader(r), dest)
+}
+
+//archives are supposed to be gzip but notes/base_container.md tars with -j, accept both
+func decompressReader(r *bufio.Reader) (io.Reader, error) {
+	magic, err := r.Peek(3)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case magic[0] == 0x1f && magic[1] == 0x8b:
+		return gzip.NewReader(r)
+	case string(magic) == "BZh":
+		return bzip2.NewReader(r), nil
+	}
+	return r, nil
+}
+
+/*
+path of name in dest. It must stay in dest, lexically and on disk: every existing directory on the way
+must be a real directory, not a symlink extracted before (x -> /etc, then x/passwd). Symlinks themselves
+may point anywhere, they are only followed once the container runs, chrooted.
+*/
+func extractPath(dest string, name string, withLast bool) (string, error) {
+	target := filepath.Join(dest, name)
+	if target != dest && strings.HasPrefix(target, dest+"/") == false {
+		return "", errors.New("Refusing to extract " + name + " outside of " + dest)
+	}
+	last := filepath.Dir(target)
+	if withLast {
+		last = target
+	}
+	for path := dest; len(path) < len(last); {
+		i := strings.Index(last[len(path)+1:], "/")
+		if i < 0 {
+			path = last
+		} else {
+			path = last[:len(path)+1+i]
+		}
+		info, err := os.Lstat(path)
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return "", errors.New("Refusing to extract " + name + " through the symlink " + path)
+		}
+	}
+	return target, nil
+}
+
+func extractTar(tr *tar.Reader, dest string) error {
+	dest = filepath.Clean(dest)
+	var dirs []*tar.Header
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		//an existing symlink in place of a directory entry would be followed by MkdirAll and chmod
+		target, err := extractPath(dest, hdr.Name, hdr.Typeflag == tar.TypeDir)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeDir {
+			os.Remove(target)
+		}
+
+		mode := uint32(hdr.Mode & 07777)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return err
+			}
+			dirs = append(dirs, hdr)
+		case tar.TypeReg, tar.TypeRegA:
+			file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(file, tr)
+			file.Close()
+			if err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			source, err := extractPath(dest, hdr.Linkname, false)
+			if err != nil {
+				return err
+			}
+			if err := os.Link(source, target); err != nil {
+				return err
+			}
+		case tar.TypeChar:
+			err = syscall.Mknod(target, syscall.S_IFCHR|mode, mkdev(hdr.Devmajor, hdr.Devminor))
+		case tar.TypeBlock:
+			err = syscall.Mknod(target, syscall.S_IFBLK|mode, mkdev(hdr.Devmajor, hdr.Devminor))
+		case tar.TypeFifo:
+			err = syscall.Mknod(target, syscall.S_IFIFO|mode, 0)
+		default:
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeLink {
+			continue
+		}
+		//numeric owner, chown before chmod as chown clears setuid bits
+		if err := os.Lchown(target, hdr.Uid, hdr.Gid); err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeSymlink {
+			continue
+		}
+		if err := os.Chmod(target, os.FileMode(mode&0777)|unixModeBits(mode)); err != nil {
+			return err
+		}
+		for key, value := range hdr.PAXRecords {
+			if strings.HasPrefix(key, "SCHILY.xattr.") {
+				if err := syscall.Setxattr(target, strings.TrimPrefix(key, "SCHILY.xattr."), []byte(value), 0); err != nil {
+					return err
+				}
+			}
+		}
+		if hdr.Typeflag != tar.TypeDir {
+			os.Chtimes(target, hdr.AccessTime, hdr.ModTime)
+		}
+	}
+	//directories times last, extracting their content changed them
+	for _, hdr := range dirs {
+		//replaced by a later entry, e.g. a symlink
+		if target, err := extractPath(dest, hdr.Name, true); err == nil {
+			os.Chtimes(target, hdr.AccessTime, hdr.ModTime)
+		}
+	}
+	return nil
+}
+
+func unixModeBits(mode uint32) os.FileMode {
+	var m os.FileMode
+	if mode&syscall.S_ISUID != 0 {
+		m |= os.ModeSetuid
+	}
+	if mode&syscall.S_ISGID != 0 {
+		m |= os.ModeSetgid
+	}
+	if mode&syscall.S_ISVTX != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
+
+//same encoding as glibc makedev
+func mkdev(major int64, minor int64) int {
+	return int(((major & 0xfff) << 8) | (minor & 0xff) | ((major &^ 0xfff) << 32) | ((minor &^ 0xff) << 12))
+}
+
+/*
+Base container
+*/
+
+func downloadBaseCN() error {
+	if fileExists(config.ImagePath + "/baseCN/rootfs") {
+		return nil
+	}
+	if config.Offline {
+		return errors.New("Base container missing in " + config.ImagePath + "/baseCN and offline mode is on. Run \"thin-lxc -a pull\" (or copy the base container) first")
+	}
+	fmt.Println("First time thin-lxc, downloading base container ...")
+	archive := config.ImagePath + "/baseCN.tar.gz"
+	sum, err := downloadFromUrl(config.ImageUrl, archive)
+	if err != nil {
+		return err
+	}
+
+	fmt.Print("Checking base container integrity ... ")
+	expectedSum, err := fetchString(config.ImageMd5Url)
+	if err != nil {
+		return err
+	}
+	if expectedSum != sum {
+		os.Remove(archive) //corrupted, download it again next time
+		return errors.New("MD5 sum check failed " + expectedSum + " != " + sum)
+	}
+	fmt.Println("Done")
+
+	fmt.Print("Extracting base container to ", config.ImagePath, " ... ")
+	//extract aside and move in place once complete, so an interrupted extraction never looks like a valid base
+	staging, err := ioutil.TempDir(config.ImagePath, ".baseCN-")
+	if err != nil {
+		return err
+	}
+	removeOnInterrupt(staging)
+	defer func() {
+		keepOnInterrupt(staging)
+		os.RemoveAll(staging)
+	}()
+	if err := extractArchive(archive, staging); err != nil {
+		return err
+	}
+	if err := os.Rename(staging+"/baseCN", config.ImagePath+"/baseCN"); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(baseDigestPath(config.ImagePath+"/baseCN"), []byte("md5:"+sum+"\n"), 0644); err != nil {
+		return err
+	}
+	fmt.Println("Done")
+	return nil
+}
+
+//download the default base container if a create needs it, custom bases (-b) are never downloaded
+func ensureBaseCN(base string) error {
+	if fileExists(base + "/rootfs") {
+		return nil
+	}
+	if path.Clean(base) != config.ImagePath + "/baseCN" {
+		return errors.New("Base container " + base + " not found (no rootfs)")
+	}
+	if err := downloadBaseCN(); err != nil {
+		return fmt.Errorf("Something went wrong while downloading base container: %v", err)
+	}
+	return nil
+}
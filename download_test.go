@@ -0,0 +1,206 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func Test_downloadFromUrl(t *testing.T) {
+	fmt.Print("Testing resumable download ... ")
+	downloadBackoff = 10 * time.Millisecond
+	content := bytes.Repeat([]byte("thin-lxc"), 4096)
+	expectedSum := fmt.Sprintf("%x", md5.Sum(content))
+
+	requests := 0
+	ranges := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		ranges = append(ranges, r.Header.Get("Range"))
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		http.ServeContent(w, r, "baseCN.tar.gz", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	dir, _ := ioutil.TempDir("", "thin-lxc-download")
+	defer os.RemoveAll(dir)
+
+	//partial file left by a previous run
+	dest := dir + "/baseCN.tar.gz"
+	ioutil.WriteFile(dest+".part", content[:1000], 0600)
+
+	sum, err := downloadFromUrl(server.URL+"/baseCN.tar.gz", dest)
+	if err != nil {
+		failTest(t, "download failed", err)
+	}
+	if sum != expectedSum {
+		failTest(t, "wrong sum", sum, expectedSum)
+	}
+	if requests != 2 || ranges[1] != "bytes=1000-" {
+		failTest(t, "download should have been retried and resumed", requests, ranges)
+	}
+	if b, _ := ioutil.ReadFile(dest); bytes.Equal(b, content) == false {
+		failTest(t, "downloaded content differs")
+	}
+	if fileExists(dest + ".part") {
+		failTest(t, "partial file not renamed")
+	}
+
+	requests = 0
+	if _, err := downloadFromUrl(server.URL+"/missing", dir+"/missing"); err == nil || requests != 1 {
+		failTest(t, "404 should fail without retrying", err, requests)
+	}
+	if fileExists(dir + "/missing") {
+		failTest(t, "404 page saved")
+	}
+	fmt.Println("OK")
+}
+
+func Test_interruptPaths(t *testing.T) {
+	fmt.Print("Testing interrupt handling ... ")
+	dir, err := ioutil.TempDir("", "thin-lxc-interrupt")
+	if err != nil {
+		failTest(t, "Temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+	part := dir + "/baseCN.tar.gz.part"
+	ioutil.WriteFile(part, []byte("partial"), 0644)
+
+	removeOnInterrupt(part)
+	if interruptSignals == nil {
+		failTest(t, "signal handler should be installed while a path is registered")
+	}
+	keepOnInterrupt(part)
+	if interruptSignals != nil {
+		failTest(t, "signal handler should be stopped once no path is registered")
+	}
+
+	//thin-lxcd
+	interruptExits = false
+	defer func() { interruptExits = true }()
+	removeOnInterrupt(part)
+	if interruptSignals != nil {
+		failTest(t, "thin-lxcd handles the signals itself")
+	}
+	removeInterruptPaths()
+	keepOnInterrupt(part)
+	if fileExists(part) {
+		failTest(t, "registered paths should be removed")
+	}
+	fmt.Println("OK")
+}
+
+func Test_extractArchive(t *testing.T) {
+	fmt.Print("Testing archive extraction ... ")
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	entries := []*tar.Header{
+		{Name: "baseCN/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "baseCN/rootfs/etc/hostname", Typeflag: tar.TypeReg, Mode: 0644, Uid: 1234, Gid: 4321, Size: 7},
+		{Name: "baseCN/rootfs/bin/sh", Typeflag: tar.TypeSymlink, Linkname: "dash"},
+		{Name: "baseCN/rootfs/dev/null", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3},
+	}
+	for _, hdr := range entries {
+		tw.WriteHeader(hdr)
+		if hdr.Size > 0 {
+			tw.Write([]byte("baseCN\n"))
+		}
+	}
+	tw.Close()
+	gz.Close()
+
+	dir, _ := ioutil.TempDir("", "thin-lxc-extract")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(dir+"/baseCN.tar.gz", buf.Bytes(), 0600)
+	if err := extractArchive(dir+"/baseCN.tar.gz", dir); err != nil {
+		failTest(t, "extraction failed", err)
+	}
+
+	info, err := os.Stat(dir + "/baseCN/rootfs/etc/hostname")
+	if err != nil {
+		failTest(t, "file not extracted", err)
+	}
+	if stat := info.Sys().(*syscall.Stat_t); stat.Uid != 1234 || stat.Gid != 4321 {
+		failTest(t, "numeric ownership not kept", stat.Uid, stat.Gid)
+	}
+	if link, _ := os.Readlink(dir + "/baseCN/rootfs/bin/sh"); link != "dash" {
+		failTest(t, "symlink not extracted", link)
+	}
+	info, err = os.Stat(dir + "/baseCN/rootfs/dev/null")
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		failTest(t, "device node not extracted", err)
+	}
+
+	//archives must not write outside of dest
+	buf.Reset()
+	tw = tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "../evil", Typeflag: tar.TypeReg, Mode: 0644})
+	tw.Close()
+	ioutil.WriteFile(dir+"/evil.tar", buf.Bytes(), 0600)
+	if err := extractArchive(dir+"/evil.tar", dir+"/baseCN"); err == nil || strings.Contains(err.Error(), "outside") == false {
+		failTest(t, "path traversal not detected", err)
+	}
+
+	//nor through links
+	outside, _ := ioutil.TempDir("", "thin-lxc-outside")
+	defer os.RemoveAll(outside)
+	ioutil.WriteFile(outside+"/secret", []byte("secret\n"), 0600)
+	malicious := map[string][]*tar.Header{
+		"symlink-parent": {
+			{Name: "x", Typeflag: tar.TypeSymlink, Linkname: outside},
+			{Name: "x/passwd", Typeflag: tar.TypeReg, Mode: 0644},
+		},
+		"symlink-dir": {
+			{Name: "d", Typeflag: tar.TypeSymlink, Linkname: outside},
+			{Name: "d/", Typeflag: tar.TypeDir, Mode: 0777},
+		},
+		"hardlink-outside": {
+			{Name: "h", Typeflag: tar.TypeLink, Linkname: "../../" + outside + "/secret"},
+		},
+		"hardlink-symlink": {
+			{Name: "y", Typeflag: tar.TypeSymlink, Linkname: outside},
+			{Name: "h", Typeflag: tar.TypeLink, Linkname: "y/secret"},
+		},
+	}
+	for name, entries := range malicious {
+		evilDest, _ := ioutil.TempDir(dir, name)
+		buf.Reset()
+		tw = tar.NewWriter(&buf)
+		for _, hdr := range entries {
+			tw.WriteHeader(hdr)
+		}
+		tw.Close()
+		ioutil.WriteFile(dir+"/"+name+".tar", buf.Bytes(), 0600)
+		if err := extractArchive(dir+"/"+name+".tar", evilDest); err == nil {
+			failTest(t, "escaping archive not refused", name)
+		}
+	}
+	if files, _ := ioutil.ReadDir(outside); len(files) != 1 {
+		failTest(t, "archive wrote outside of dest", files)
+	}
+	if info, _ := os.Stat(outside); info.Mode().Perm() != 0700 {
+		failTest(t, "archive changed a directory outside of dest", info.Mode())
+	}
+	if info, _ := os.Stat(outside + "/secret"); info.Sys().(*syscall.Stat_t).Nlink != 1 {
+		failTest(t, "archive linked a file outside of dest")
+	}
+	fmt.Println("OK")
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const DEFAULT_STATE_TIMEOUT = 30 * time.Second
+const STATE_POLL_INTERVAL = 2 * time.Second
+
+/*
+State changes of the containers, from lxc-monitor:
+
+'web' changed state to [STARTING]
+'web' changed state to [RUNNING]
+
+A watcher runs one lxc-monitor and publishes every change to its subscribers. Waits also poll
+the runtime every few seconds: lxc-monitor may be missing, or start after the change.
+*/
+
+type stateEvent struct {
+	Name string
+	State string
+	Time time.Time
+}
+
+var monitorLine = regexp.MustCompile(`^'(.+)' changed state to \[([A-Z]+)\]`)
+
+func parseMonitorLine(line string) (stateEvent, bool) {
+	m := monitorLine.FindStringSubmatch(line)
+	if m == nil {
+		return stateEvent{}, false
+	}
+	return stateEvent{m[1], m[2], time.Now().UTC()}, true
+}
+
+type stateWatcher struct {
+	mutex sync.Mutex
+	subscribers map[chan stateEvent]bool
+}
+
+func newStateWatcher() *stateWatcher {
+	return &stateWatcher{subscribers: make(map[chan stateEvent]bool)}
+}
+
+func (w *stateWatcher) subscribe() chan stateEvent {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	events := make(chan stateEvent, 64)
+	w.subscribers[events] = true
+	return events
+}
+
+func (w *stateWatcher) unsubscribe(events chan stateEvent) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	delete(w.subscribers, events)
+}
+
+//never blocks, a subscriber that doesn't keep up misses events
+func (w *stateWatcher) publish(e stateEvent) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for events := range w.subscribers {
+		select {
+		case events <- e:
+		default:
+			log.Println("State event of", e.Name, "dropped, subscriber too slow")
+		}
+	}
+}
+
+//one lxc-monitor, until it exits or ctx is done
+func (w *stateWatcher) monitor(ctx context.Context, lxcPath string) error {
+	cmd := exec.CommandContext(ctx, "lxc-monitor", "-P", lxcPath, "-n", ".*")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		if e, ok := parseMonitorLine(scanner.Text()); ok {
+			w.publish(e)
+		}
+	}
+	if err := cmd.Wait(); err != nil {
+		return err
+	}
+	return errors.New("lxc-monitor exited")
+}
+
+//runs lxc-monitor until ctx is done, restarting it if it exits
+func (w *stateWatcher) run(ctx context.Context, lxcPath string) error {
+	if _, err := exec.LookPath("lxc-monitor"); err != nil {
+		return err
+	}
+	for {
+		err := w.monitor(ctx, lxcPath)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(time.Second):
+			log.Println("lxc-monitor exited, restarting", err)
+		}
+	}
+}
+
+//watcher running until ctx is done, lxc-monitor failures are logged
+func watchStates(ctx context.Context) *stateWatcher {
+	w := newStateWatcher()
+	go func() {
+		if err := w.run(ctx, config.LxcPath); err != nil {
+			log.Println("Unable to watch state changes, polling", err)
+		}
+	}()
+	return w
+}
+
+/*
+Usage:
+ctx, cancel := context.WithTimeout(context.Background(), DEFAULT_STATE_TIMEOUT)
+defer cancel()
+state, err := c.waitForState(ctx, watcher, C_RUNNING)
+
+Fails as soon as a start failed (see startFailed) instead of waiting for the timeout.
+*/
+func (c *Container) waitForState(ctx context.Context, w *stateWatcher, state string) (string, error) {
+	events := w.subscribe()
+	defer w.unsubscribe(events)
+	poll := time.NewTicker(STATE_POLL_INTERVAL)
+	defer poll.Stop()
+	current := c.state()
+	//right after lxc-start the container may still be STOPPED
+	started := current != C_STOPPED
+	for current != state {
+		if state == C_RUNNING && startFailed(current, started) {
+			return current, fmt.Errorf("%s is %s, failed to reach %s", c.Name, current, state)
+		}
+		select {
+		case e := <-events:
+			if e.Name == c.Name {
+				current = e.State
+				started = started || current != C_STOPPED
+			}
+		case <-poll.C:
+			current = c.state()
+			//a poll interval after lxc-start returned, still STOPPED means it stopped
+			started = true
+		case <-ctx.Done():
+			return current, fmt.Errorf("%s is %s, timed out waiting for %s", c.Name, current, state)
+		}
+	}
+	return current, nil
+}
+
+//ABORTING or back to STOPPED once started, the container won't get RUNNING on its own
+func startFailed(current string, started bool) bool {
+	return current == "ABORTING" || (current == C_STOPPED && started)
+}
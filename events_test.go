@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func Test_stateEvents(t *testing.T) {
+	fmt.Print("Testing state events ... ")
+	if e, ok := parseMonitorLine("'web-1' changed state to [RUNNING]"); ok == false || e.Name != "web-1" || e.State != C_RUNNING {
+		failTest(t, "state change not parsed", e)
+	}
+	if _, ok := parseMonitorLine("'web-1' exited with status [0]"); ok {
+		failTest(t, "only state changes expected")
+	}
+
+	w := newStateWatcher()
+	c := &Container{Name: "web"}
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+	go func() {
+		//until the wait has subscribed
+		for i := 0; i < 50; i++ {
+			w.publish(stateEvent{"db", C_RUNNING, time.Now()})
+			w.publish(stateEvent{"web", C_RUNNING, time.Now()})
+			time.Sleep(100 * time.Millisecond)
+		}
+	}()
+	if state, err := c.waitForState(ctx, w, C_RUNNING); err != nil || state != C_RUNNING {
+		failTest(t, "running state expected", state, err)
+	}
+
+	short, cancelShort := context.WithTimeout(context.Background(), 200 * time.Millisecond)
+	defer cancelShort()
+	if _, err := c.waitForState(short, w, C_STOPPED); err == nil {
+		failTest(t, "wait should time out")
+	}
+	fmt.Println("OK")
+}
+
+func Test_stateFailedStart(t *testing.T) {
+	fmt.Print("Testing waits on failed starts ... ")
+	if startFailed(C_STOPPED, false) {
+		failTest(t, "stopped right after lxc-start is not a failure yet")
+	}
+	if startFailed(C_STOPPED, true) == false || startFailed("ABORTING", false) == false {
+		failTest(t, "stopped once started and aborting are failures")
+	}
+
+	w := newStateWatcher()
+	c := &Container{Name: "web"}
+	ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+	defer cancel()
+	go func() {
+		for i := 0; i < 50; i++ {
+			w.publish(stateEvent{"web", C_STARTING, time.Now()})
+			w.publish(stateEvent{"web", "ABORTING", time.Now()})
+			w.publish(stateEvent{"web", C_STOPPED, time.Now()})
+			time.Sleep(100 * time.Millisecond)
+		}
+	}()
+	begin := time.Now()
+	state, err := c.waitForState(ctx, w, C_RUNNING)
+	if err == nil || ctx.Err() != nil || time.Since(begin) > 5 * time.Second {
+		failTest(t, "failed start should be reported before the timeout", state, err)
+	}
+	if state != "ABORTING" && state != C_STOPPED {
+		failTest(t, "real state expected", state)
+	}
+	fmt.Println("OK")
+}
+
+func Test_stateMonitor(t *testing.T) {
+	fmt.Print("Testing lxc-monitor failures ... ")
+	dir, err := ioutil.TempDir("", "thin-lxc-monitor")
+	if err != nil {
+		failTest(t, "Temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+	path := os.Getenv("PATH")
+	defer os.Setenv("PATH", path)
+
+	w := newStateWatcher()
+	events := w.subscribe()
+	os.Setenv("PATH", dir)
+	if err := w.monitor(context.Background(), dir); err == nil {
+		failTest(t, "missing lxc-monitor should fail")
+	}
+
+	script := "#!/bin/sh\necho \"'web' changed state to [RUNNING]\"\nexit 1\n"
+	if err := ioutil.WriteFile(dir + "/lxc-monitor", []byte(script), 0755); err != nil {
+		failTest(t, "Fake lxc-monitor", err)
+	}
+	os.Setenv("PATH", dir + ":" + path)
+	if err := w.monitor(context.Background(), dir); err == nil {
+		failTest(t, "exited lxc-monitor should fail")
+	}
+	if len(events) != 1 {
+		failTest(t, "event before the exit expected", len(events))
+	}
+	fmt.Println("OK")
+}
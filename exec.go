@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+//exit code of exec when thin-lxc fails, not the command
+const EXEC_FAILED = 125
+
+/*
+thin-lxc -a exec -n web [-env KEY=value] [-user name[:group]] [-cwd /srv] [-tty] -- cmd args
+
+Runs the command in the running container through the runtime, with the stdin, stdout, stderr
+and exit code of thin-lxc. Without -tty the command gets pipes, even from a terminal. Users
+and groups are resolved in the container /etc/passwd and /etc/group.
+*/
+
+type passwdEntry struct {
+	Name string
+	Uid int
+	Gid int
+	Home string
+}
+
+//name:x:uid:gid:gecos:home:shell, or name:x:gid:members for /etc/group (Home empty)
+func readPasswd(path string) ([]passwdEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	entries := []passwdEntry{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) < 3 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		e := passwdEntry{Name: fields[0], Gid: -1}
+		if e.Uid, err = strconv.Atoi(fields[2]); err != nil {
+			continue
+		}
+		if len(fields) >= 7 {
+			e.Gid, _ = strconv.Atoi(fields[3])
+			e.Home = fields[5]
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+//name or id, ids don't have to exist
+func lookupId(entries []passwdEntry, id string) (passwdEntry, error) {
+	for _, e := range entries {
+		if e.Name == id || strconv.Itoa(e.Uid) == id {
+			return e, nil
+		}
+	}
+	if n, err := strconv.Atoi(id); err == nil && n >= 0 {
+		return passwdEntry{Name: id, Uid: n, Gid: -1}, nil
+	}
+	return passwdEntry{}, errors.New("Unknown user or group " + id)
+}
+
+//-user name[:group] resolved in the container rootfs, sets HOME and USER unless given
+func (c *Container) setUser(opts *attachOptions, user string) error {
+	if len(user) == 0 {
+		return nil
+	}
+	arr := strings.SplitN(user, ":", 2)
+	users, err := readPasswd(c.Rootfs + "/etc/passwd")
+	if err != nil {
+		return err
+	}
+	u, err := lookupId(users, arr[0])
+	if err != nil {
+		return err
+	}
+	opts.Uid, opts.Gid = u.Uid, u.Gid
+	if len(arr) == 2 {
+		groups, err := readPasswd(c.Rootfs + "/etc/group")
+		if err != nil {
+			return err
+		}
+		g, err := lookupId(groups, arr[1])
+		if err != nil {
+			return err
+		}
+		opts.Gid = g.Uid
+	}
+	if opts.Gid < 0 {
+		opts.Gid = opts.Uid
+	}
+	for _, kv := range []string{"HOME=" + u.Home, "USER=" + u.Name} {
+		if len(u.Home) == 0 && strings.HasPrefix(kv, "HOME=") {
+			continue
+		}
+		if hasEnv(opts.Env, strings.SplitN(kv, "=", 2)[0]) == false {
+			opts.Env = append(opts.Env, kv)
+		}
+	}
+	return nil
+}
+
+func hasEnv(env []string, key string) bool {
+	for _, kv := range env {
+		if strings.SplitN(kv, "=", 2)[0] == key {
+			return true
+		}
+	}
+	return false
+}
+
+//-env KEY=value, or KEY for its value on the host
+func parseEnvArgs(args []string) ([]string, error) {
+	env := []string{}
+	for _, arg := range args {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv[0]) == 0 {
+			return nil, errors.New("Invalid environment variable " + arg)
+		}
+		if len(kv) == 1 {
+			arg = kv[0] + "=" + os.Getenv(kv[0])
+		}
+		env = append(env, arg)
+	}
+	return env, nil
+}
+
+func isTerminal(f *os.File) bool {
+	var termios syscall.Termios
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), syscall.TCGETS, uintptr(unsafe.Pointer(&termios)))
+	return errno == 0
+}
+
+/*
+stdio of the command through pipes, so it never gets the terminal. The returned function is
+called once the command exited, it waits for the output to be copied.
+*/
+func pipeStdio(opts *attachOptions) (func(), error) {
+	stdinR, stdinW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	stderrR, stderrW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		io.Copy(stdinW, os.Stdin)
+		stdinW.Close()
+	}()
+	copied := make(chan bool)
+	for _, p := range [][]*os.File{{os.Stdout, stdoutR}, {os.Stderr, stderrR}} {
+		go func(dst *os.File, src *os.File) {
+			io.Copy(dst, src)
+			copied <- true
+		}(p[0], p[1])
+	}
+	opts.Stdin, opts.Stdout, opts.Stderr = stdinR, stdoutW, stderrW
+	return func() {
+		stdinR.Close()
+		stdoutW.Close()
+		stderrW.Close()
+		<-copied
+		<-copied
+	}, nil
+}
+
+//exit code of the command
+func (c *Container) exec(command []string, opts attachOptions, tty bool) (int, error) {
+	if len(command) == 0 {
+		return EXEC_FAILED, errors.New("No command given, thin-lxc -a exec -n NAME -- cmd args")
+	}
+	if state := c.state(); state != C_RUNNING {
+		return EXEC_FAILED, errors.New("Container " + c.Name + " is not running (" + state + ")")
+	}
+	opts.Stdin, opts.Stdout, opts.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if tty && isTerminal(os.Stdin) == false {
+		return EXEC_FAILED, errors.New("-tty needs stdin to be a terminal")
+	}
+	if tty == false {
+		done, err := pipeStdio(&opts)
+		if err != nil {
+			return EXEC_FAILED, err
+		}
+		defer done()
+	}
+	code, err := c.runtime().attach(context.Background(), c, command, opts)
+	if err != nil {
+		return EXEC_FAILED, err
+	}
+	return code, nil
+}
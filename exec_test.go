@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+type execRuntime struct {
+	fakeRuntime
+	command []string
+	opts attachOptions
+}
+
+func (r *execRuntime) attach(ctx context.Context, c *Container, command []string, opts attachOptions) (int, error) {
+	r.command, r.opts = command, opts
+	return 3, nil
+}
+
+func Test_exec(t *testing.T) {
+	fmt.Print("Testing exec ... ")
+	rootfs, _ := ioutil.TempDir("", "thin-lxc-exec")
+	defer os.RemoveAll(rootfs)
+	os.MkdirAll(rootfs + "/etc", 0755)
+	ioutil.WriteFile(rootfs + "/etc/passwd", []byte("root:x:0:0:root:/root:/bin/bash\npostgres:x:105:110:PostgreSQL:/var/lib/postgresql:/bin/bash\n"), 0644)
+	ioutil.WriteFile(rootfs + "/etc/group", []byte("root:x:0:\nadm:x:4:syslog\n"), 0644)
+	c := &Container{Name: "db", Rootfs: rootfs}
+
+	opts := attachOptions{Env: []string{"USER=pg"}}
+	if err := c.setUser(&opts, "postgres:adm"); err != nil || opts.Uid != 105 || opts.Gid != 4 {
+		failTest(t, "user and group not resolved", opts, err)
+	}
+	if strings.Join(opts.Env, " ") != "USER=pg HOME=/var/lib/postgresql" {
+		failTest(t, "HOME should be set, USER kept", opts.Env)
+	}
+	opts = attachOptions{}
+	if err := c.setUser(&opts, "1000"); err != nil || opts.Uid != 1000 || opts.Gid != 1000 {
+		failTest(t, "numeric uid should be accepted", opts, err)
+	}
+	if err := c.setUser(&attachOptions{}, "nobody"); err == nil {
+		failTest(t, "unknown user should fail")
+	}
+	os.Setenv("THIN_LXC_TEST", "on")
+	if env, err := parseEnvArgs([]string{"A=1=2", "THIN_LXC_TEST"}); err != nil || strings.Join(env, " ") != "A=1=2 THIN_LXC_TEST=on" {
+		failTest(t, "environment not parsed", env, err)
+	}
+	if _, err := parseEnvArgs([]string{"=1"}); err == nil {
+		failTest(t, "empty variable name should fail")
+	}
+
+	r := &execRuntime{fakeRuntime: fakeRuntime{current: C_STOPPED}}
+	runtimes["exec"] = r
+	defer delete(runtimes, "exec")
+	defer func() { config.Runtime = "" }()
+	config.Runtime = "exec"
+	if code, err := c.exec([]string{"ls"}, attachOptions{}, false); err == nil || code != EXEC_FAILED {
+		failTest(t, "exec in a stopped container should be refused", code, err)
+	}
+	r.current = C_RUNNING
+	if code, err := c.exec(nil, attachOptions{}, false); err == nil || code != EXEC_FAILED {
+		failTest(t, "exec without command should fail", code, err)
+	}
+	if code, err := c.exec([]string{"false"}, attachOptions{Cwd: "/srv"}, false); err != nil || code != 3 {
+		failTest(t, "exit code should pass through", code, err)
+	}
+	if r.command[0] != "false" || r.opts.Cwd != "/srv" || r.opts.Stdout == os.Stdout {
+		failTest(t, "command should run without terminal", r.command, r.opts)
+	}
+	fmt.Println("OK")
+}
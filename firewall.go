@@ -0,0 +1,317 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+const BRIDGE_NF_CALL_IPTABLES = "/proc/sys/net/bridge/bridge-nf-call-iptables"
+const BRIDGE_NF_CALL_IP6TABLES = "/proc/sys/net/bridge/bridge-nf-call-ip6tables"
+
+const (
+	POLICY_ALLOW = "allow"
+	POLICY_DENY = "deny"
+)
+
+/*
+Per container firewall policy, a chain of the firewall backend per container, jumped to from the
+forward chain (THIN-LXC-FORWARD, jumped to from the top of FORWARD, with iptables) for traffic to
+and from the container. Replies and published ports (-p) are always allowed, then the allow rules,
+then the drops:
+
+-isolate            no traffic with other containers of the subnet
+-ingress deny       no new connection to the container
+-egress deny        no new connection from the container
+-allow-in / -allow-out  exceptions e.g: 10.0.3.13:5432, 10.0.0.0/8:443/tcp, :53/udp, [fd00::13]:5432
+
+Allowed traffic returns from the chain instead of being accepted, so traffic between two containers
+goes through the policies of both. Containers with an ipv6 address get the same rules in ipv6, allow
+rules apply to the peers of their family.
+
+Traffic from containers is matched on their address, with iptables on their veth when its name is
+known (-net name=eth0,veth=...). Traffic between containers of the bridge only goes through FORWARD with
+br_netfilter, it is turned on when a container has a policy. The host itself is not filtered
+(INPUT / OUTPUT).
+*/
+
+type FirewallPolicy struct {
+	Isolate bool
+	Ingress string
+	Egress string
+	AllowIn []string
+	AllowOut []string
+}
+
+func (p FirewallPolicy) isEmpty() bool {
+	return p.Isolate == false && p.Ingress != POLICY_DENY && p.Egress != POLICY_DENY
+}
+
+//"addr[:port[/proto]]", addr is an ip, a cidr or empty for any, ipv6 ones in brackets with a port
+func parseFirewallRule(rule string) (addr string, port int, proto string, err error) {
+	proto = "tcp"
+	addr, portProto := rule, ""
+	switch {
+	case strings.HasPrefix(rule, "["):
+		i := strings.Index(rule, "]")
+		if i < 0 || (i+1 < len(rule) && rule[i+1] != ':') {
+			return "", 0, "", errors.New("Invalid address in firewall rule " + rule)
+		}
+		addr, portProto = rule[1:i], strings.TrimPrefix(rule[i+1:], ":")
+	case strings.Count(rule, ":") > 1:
+		//ipv6 without port
+	case strings.Contains(rule, ":"):
+		i := strings.LastIndex(rule, ":")
+		addr, portProto = rule[:i], rule[i+1:]
+	}
+	if len(portProto) > 0 || strings.HasSuffix(rule, ":") {
+		arr := strings.SplitN(portProto, "/", 2)
+		if port, err = strconv.Atoi(arr[0]); err != nil || port <= 0 || port > 65535 {
+			return "", 0, "", errors.New("Invalid port in firewall rule " + rule)
+		}
+		if len(arr) == 2 {
+			proto = arr[1]
+		}
+	}
+	if proto != "tcp" && proto != "udp" {
+		return "", 0, "", errors.New("Invalid protocol in firewall rule " + rule + ", expected tcp or udp")
+	}
+	if len(addr) > 0 && net.ParseIP(addr) == nil {
+		if _, _, err := net.ParseCIDR(addr); err != nil {
+			return "", 0, "", errors.New("Invalid address in firewall rule " + rule)
+		}
+	}
+	return addr, port, proto, nil
+}
+
+//ipv6 address or cidr
+func isIp6Peer(addr string) bool {
+	return strings.Contains(addr, ":")
+}
+
+func (p FirewallPolicy) validate() error {
+	for _, policy := range []string{p.Ingress, p.Egress} {
+		if len(policy) > 0 && policy != POLICY_ALLOW && policy != POLICY_DENY {
+			return errors.New("Invalid firewall policy " + policy + ", expected allow or deny")
+		}
+	}
+	if len(p.AllowIn) > 0 && p.Isolate == false && p.Ingress != POLICY_DENY {
+		return errors.New("-allow-in needs -isolate or -ingress deny")
+	}
+	if len(p.AllowOut) > 0 && p.Isolate == false && p.Egress != POLICY_DENY {
+		return errors.New("-allow-out needs -isolate or -egress deny")
+	}
+	for _, rule := range append(append([]string{}, p.AllowIn...), p.AllowOut...) {
+		if _, _, _, err := parseFirewallRule(rule); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Container) setFirewallPolicy(p FirewallPolicy) error {
+	if err := p.validate(); err != nil {
+		return err
+	}
+	if p.isEmpty() == false && c.HasVeth() == false {
+		return errors.New("Firewall policies need eth0 to be a veth")
+	}
+	c.Firewall = p
+	return nil
+}
+
+type policyRule struct {
+	egress bool     //from the container, else to it
+	peer string     //address or cidr of the other end, any if empty
+	port int        //0 for any
+	proto string
+	state string    //conntrack, "ESTABLISHED,RELATED" or "DNAT"
+	verdict string  //RETURN (allowed, the policy of the peer still applies) or DROP
+}
+
+//ipv4, and ipv6 if the container has it
+func (c *Container) policyFamilies() []bool {
+	if c.HasIp6() {
+		return []bool{false, true}
+	}
+	return []bool{false}
+}
+
+func (c *Container) policyAddress(ip6 bool) string {
+	if ip6 {
+		return c.Ip6
+	}
+	return c.Address()
+}
+
+//rules of the container chain in order: replies and published port, allow rules, drops
+func (c *Container) policyRules(ip6 bool) []policyRule {
+	p := c.Firewall
+	if p.isEmpty() {
+		return nil
+	}
+	subnet := c.Subnet
+	if ip6 {
+		subnet = c.Subnet6
+	}
+	rules := []policyRule{}
+
+	//egress
+	rules = append(rules, policyRule{egress: true, state: "ESTABLISHED,RELATED", verdict: "RETURN"})
+	for _, rule := range p.AllowOut {
+		addr, port, proto, _ := parseFirewallRule(rule)
+		if len(addr) == 0 || isIp6Peer(addr) == ip6 {
+			rules = append(rules, policyRule{egress: true, peer: addr, port: port, proto: proto, verdict: "RETURN"})
+		}
+	}
+	if p.Isolate {
+		rules = append(rules, policyRule{egress: true, peer: subnet, verdict: "DROP"})
+	}
+	if p.Egress == POLICY_DENY {
+		rules = append(rules, policyRule{egress: true, verdict: "DROP"})
+	}
+
+	//ingress
+	rules = append(rules, policyRule{state: "ESTABLISHED,RELATED", verdict: "RETURN"})
+	if c.Port > 0 {
+		rules = append(rules, policyRule{port: c.Port, proto: "tcp", state: "DNAT", verdict: "RETURN"})
+	}
+	for _, rule := range p.AllowIn {
+		addr, port, proto, _ := parseFirewallRule(rule)
+		if len(addr) == 0 || isIp6Peer(addr) == ip6 {
+			rules = append(rules, policyRule{peer: addr, port: port, proto: proto, verdict: "RETURN"})
+		}
+	}
+	if p.Isolate {
+		rules = append(rules, policyRule{peer: subnet, verdict: "DROP"})
+	}
+	if p.Ingress == POLICY_DENY {
+		rules = append(rules, policyRule{verdict: "DROP"})
+	}
+	return rules
+}
+
+/*
+Firewall backends, for published ports (-p) and policies. iptables (see iptables.go) or nftables
+(see nftables.go), firewall in the host config:
+
+auto       nftables if nft is installed and iptables is missing or is the nf_tables shim
+iptables
+nftables
+
+The backend used is saved in the container metadata, destroy removes the rules with it and reload
+moves the rules to the configured one.
+*/
+
+const (
+	FIREWALL_AUTO = "auto"
+	FIREWALL_IPTABLES = "iptables"
+	FIREWALL_NFTABLES = "nftables"
+)
+
+type firewallBackend interface {
+	forwardPort(c *Container) error //ipv4, and ipv6 if the container has it
+	unforwardPort(c *Container) error
+	portForwarded(c *Container) bool
+	applyPolicy(c *Container) error //missing rules only, so it can run on reload, ipv6 as well
+	removePolicy(c *Container) error
+	flush(containers []*Container) error //every rule thin-lxc owns
+}
+
+var firewallBackends = map[string]firewallBackend{
+	FIREWALL_IPTABLES: iptablesBackend{},
+	FIREWALL_NFTABLES: nftablesBackend{},
+}
+
+//backend name to use for new rules
+func selectFirewall(name string) string {
+	if name != FIREWALL_AUTO {
+		return name
+	}
+	if _, err := exec.LookPath("nft"); err != nil {
+		return FIREWALL_IPTABLES
+	}
+	out, err := exec.Command("iptables", "-V").CombinedOutput()
+	if err != nil || strings.Contains(string(out), "nf_tables") {
+		return FIREWALL_NFTABLES
+	}
+	return FIREWALL_IPTABLES
+}
+
+//backend of the container rules, iptables for containers created before backends
+func (c *Container) firewall() firewallBackend {
+	if b, ok := firewallBackends[c.FirewallBackend]; ok {
+		return b
+	}
+	return firewallBackends[FIREWALL_IPTABLES]
+}
+
+func (c *Container) forwardPort() error {
+	if c.Port == 0 && c.HostPort == 0 {
+		return nil
+	}
+	if c.hasProxy() {
+		return c.startProxy()
+	}
+	if len(c.Address()) == 0 {
+		return errors.New("Port forwarding of " + c.Name + " needs its address")
+	}
+	return c.firewall().forwardPort(c)
+}
+
+func (c *Container) unforwardPort() error {
+	if c.hasProxy() {
+		return c.stopProxy()
+	}
+	return c.firewall().unforwardPort(c)
+}
+
+func (c *Container) applyFirewall() error {
+	if c.Firewall.isEmpty() {
+		return nil
+	}
+	if len(c.Address()) == 0 {
+		return errors.New("Firewall policy of " + c.Name + " needs its address")
+	}
+	if err := enableBridgeFiltering(); err != nil {
+		return err
+	}
+	return c.firewall().applyPolicy(c)
+}
+
+func (c *Container) removeFirewall() error {
+	return c.firewall().removePolicy(c)
+}
+
+//reload, remove the rules from the old backend, they are added to the new one afterwards
+func (c *Container) switchFirewall(name string) error {
+	if name == c.FirewallBackend || (name == FIREWALL_IPTABLES && len(c.FirewallBackend) == 0) {
+		return nil
+	}
+	if err := c.unforwardPort(); err != nil {
+		return err
+	}
+	if err := c.removeFirewall(); err != nil {
+		return err
+	}
+	c.FirewallBackend = name
+	return c.marshall()
+}
+
+//bridged traffic (container to container) through iptables and ip6tables, lost on reboot like iptables rules
+func enableBridgeFiltering() error {
+	if fileExists(BRIDGE_NF_CALL_IPTABLES) == false {
+		if err := runCmdWithDetailedError(exec.Command("modprobe", "br_netfilter")); err != nil {
+			return err
+		}
+	}
+	for _, path := range []string{BRIDGE_NF_CALL_IPTABLES, BRIDGE_NF_CALL_IP6TABLES} {
+		if err := ioutil.WriteFile(path, []byte("1\n"), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
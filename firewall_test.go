@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+func Test_firewallRules(t *testing.T) {
+	fmt.Print("Testing firewall policies ... ")
+	addr, port, proto, err := parseFirewallRule("10.0.0.0/8:53/udp")
+	if err != nil || addr != "10.0.0.0/8" || port != 53 || proto != "udp" {
+		failTest(t, "rule parsing failed", addr, port, proto, err)
+	}
+	addr, port, _, err = parseFirewallRule("[fd00:10:0:3::13]:5432")
+	if err != nil || addr != "fd00:10:0:3::13" || port != 5432 {
+		failTest(t, "ipv6 rule parsing failed", addr, port, err)
+	}
+	if addr, port, _, err = parseFirewallRule("fd00:10:0:3::/64"); err != nil || addr != "fd00:10:0:3::/64" || port != 0 {
+		failTest(t, "ipv6 cidr parsing failed", addr, port, err)
+	}
+	for _, rule := range []string{"10.0.3.13:http", "10.0.3.13:80/icmp", "db:5432", "10.0.3.13:70000", "10.0.3.13:", "[fd00::13", "[fd00::13]5432"} {
+		if _, _, _, err := parseFirewallRule(rule); err == nil {
+			failTest(t, "invalid rule should fail", rule)
+		}
+	}
+	if err := (FirewallPolicy{Egress: "drop"}).validate(); err == nil {
+		failTest(t, "invalid policy should fail")
+	}
+	if err := (FirewallPolicy{AllowOut: []string{":443"}}).validate(); err == nil {
+		failTest(t, "allow rules without a deny policy should fail")
+	}
+
+	c := &Container{Name: "web", Ip: "10.0.3.12", Subnet: DEFAULT_SUBNET, Port: 80, HostPort: 8080}
+	if len(c.firewallRules(false)) != 0 {
+		failTest(t, "no policy should give no rules")
+	}
+	if err := c.setFirewallPolicy(FirewallPolicy{Isolate: true, Egress: POLICY_DENY, AllowOut: []string{"10.0.3.13:5432", ":53/udp"}}); err != nil {
+		failTest(t, "setFirewallPolicy failed", err)
+	}
+	rules := []string{}
+	for _, rule := range c.firewallRules(false) {
+		rules = append(rules, strings.Join(rule, " "))
+	}
+	expected := []string{
+		"-s 10.0.3.12 -m conntrack --ctstate ESTABLISHED,RELATED -j RETURN",
+		"-s 10.0.3.12 -d 10.0.3.13 -p tcp --dport 5432 -j RETURN",
+		"-s 10.0.3.12 -p udp --dport 53 -j RETURN",
+		"-s 10.0.3.12 -d 10.0.3.0/24 -j DROP",
+		"-s 10.0.3.12 -j DROP",
+		"-d 10.0.3.12 -m conntrack --ctstate ESTABLISHED,RELATED -j RETURN",
+		"-d 10.0.3.12 -p tcp --dport 80 -m conntrack --ctstate DNAT -j RETURN",
+		"-d 10.0.3.12 -s 10.0.3.0/24 -j DROP",
+	}
+	if strings.Join(rules, "\n") != strings.Join(expected, "\n") {
+		failTest(t, "unexpected rules", rules)
+	}
+
+	//matched on the veth when known
+	c.VethPair = "vethweb"
+	if rule := strings.Join(c.firewallRules(false)[0], " "); strings.HasPrefix(rule, "-m physdev --physdev-in vethweb ") == false {
+		failTest(t, "egress not matched on the veth", rule)
+	}
+	fmt.Println("OK")
+}
+
+//verdict of a new connection going through THIN-LXC-FORWARD: the chains of the containers it comes
+//from or goes to, in order, until one drops (or accepts) it
+func forwardVerdict(containers []*Container, ip6 bool, src string, dst string, port int) string {
+	inPeer := func(addr string, peer string) bool {
+		if len(peer) == 0 || peer == addr {
+			return true
+		}
+		_, n, err := net.ParseCIDR(peer)
+		return err == nil && n.Contains(net.ParseIP(addr))
+	}
+	for _, c := range containers {
+		addr := c.policyAddress(ip6)
+		if c.Firewall.isEmpty() || (src != addr && dst != addr) {
+			continue
+		}
+		for _, r := range c.policyRules(ip6) {
+			other := src
+			if r.egress {
+				other = dst
+			}
+			if (r.egress && src != addr) || (r.egress == false && dst != addr) {
+				continue
+			}
+			//new connections, no DNAT
+			if len(r.state) > 0 || inPeer(other, r.peer) == false || (r.port > 0 && r.port != port) {
+				continue
+			}
+			if r.verdict != "RETURN" {
+				return r.verdict
+			}
+			break
+		}
+	}
+	return "ACCEPT"
+}
+
+func Test_firewallTwoContainers(t *testing.T) {
+	fmt.Print("Testing firewall policies of two containers ... ")
+	a := &Container{Name: "web", Ip: "10.0.3.12", Subnet: DEFAULT_SUBNET, Ip6: "fd00:10:0:3::12", Subnet6: "fd00:10:0:3::/64"}
+	b := &Container{Name: "db", Ip: "10.0.3.13", Subnet: DEFAULT_SUBNET, Ip6: "fd00:10:0:3::13", Subnet6: "fd00:10:0:3::/64"}
+	if err := a.setFirewallPolicy(FirewallPolicy{Egress: POLICY_DENY, AllowOut: []string{"10.0.3.0/24:80", "[fd00:10:0:3::/64]:80"}}); err != nil {
+		failTest(t, "setFirewallPolicy failed", err)
+	}
+	if err := b.setFirewallPolicy(FirewallPolicy{Isolate: true}); err != nil {
+		failTest(t, "setFirewallPolicy failed", err)
+	}
+	containers := []*Container{a, b}
+
+	//allowed by web, still denied by db, in both orders
+	for _, order := range [][]*Container{{a, b}, {b, a}} {
+		if v := forwardVerdict(order, false, "10.0.3.12", "10.0.3.13", 80); v != "DROP" {
+			failTest(t, "allow rule of web should not bypass the isolation of db", v)
+		}
+		if v := forwardVerdict(order, true, "fd00:10:0:3::12", "fd00:10:0:3::13", 80); v != "DROP" {
+			failTest(t, "db should be isolated in ipv6 too", v)
+		}
+	}
+	if v := forwardVerdict(containers, false, "10.0.3.12", "10.0.3.14", 80); v != "ACCEPT" {
+		failTest(t, "allow rule of web should apply to other containers", v)
+	}
+	if v := forwardVerdict(containers, false, "10.0.3.12", "10.0.3.14", 443); v != "DROP" {
+		failTest(t, "egress deny of web should apply", v)
+	}
+
+	//no verdict of a container ends the traversal of the chains
+	for _, c := range containers {
+		for _, ip6 := range c.policyFamilies() {
+			for _, rule := range c.firewallRules(ip6) {
+				if rule[len(rule)-1] == "ACCEPT" {
+					failTest(t, "container chains should return, not accept", c.Name, rule)
+				}
+			}
+		}
+	}
+
+	//a chain per container, with their own jumps, so removing one keeps the other
+	if a.firewallChain() == b.firewallChain() {
+		failTest(t, "containers should have their own chain")
+	}
+	jumps := []string{}
+	for _, ip6 := range []bool{false, true} {
+		for _, jump := range b.firewallJumps(ip6) {
+			jumps = append(jumps, strings.Join(jump, " "))
+		}
+	}
+	expected := []string{
+		"-d 10.0.3.13 -j THIN-LXC-CT-db",
+		"-s 10.0.3.13 -j THIN-LXC-CT-db",
+		"-d fd00:10:0:3::13 -j THIN-LXC-CT-db",
+		"-s fd00:10:0:3::13 -j THIN-LXC-CT-db",
+	}
+	if strings.Join(jumps, "\n") != strings.Join(expected, "\n") {
+		failTest(t, "unexpected jumps", jumps)
+	}
+	rules6 := []string{}
+	for _, rule := range a.firewallRules(true) {
+		rules6 = append(rules6, strings.Join(rule, " "))
+	}
+	if strings.Contains(strings.Join(rules6, "\n"), "10.0.3.0/24") || strings.Contains(strings.Join(rules6, "\n"), "-d fd00:10:0:3::/64 -p tcp --dport 80 -j RETURN") == false {
+		failTest(t, "ipv6 rules should only have ipv6 peers", rules6)
+	}
+
+	long := &Container{Name: "a-very-long-container-name-1"}
+	other := &Container{Name: "a-very-long-container-name-2"}
+	if len(long.firewallChain()) > 28 || long.firewallChain() == other.firewallChain() {
+		failTest(t, "chain names should fit iptables", long.firewallChain(), other.firewallChain())
+	}
+	fmt.Println("OK")
+}
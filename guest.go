@@ -0,0 +1,411 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+/*
+Guest detection, done on the base container rootfs when a container is created
+*/
+
+const (
+	INIT_UPSTART = "upstart"
+	INIT_SYSTEMD = "systemd"
+	INIT_OPENRC = "openrc"
+)
+
+//distro families, each with its own network configuration
+const (
+	DISTRO_DEBIAN = "debian" //debian, ubuntu
+	DISTRO_RHEL = "rhel"     //rhel, centos, fedora ...
+	DISTRO_ALPINE = "alpine"
+	DISTRO_ARCH = "arch"
+)
+
+const (
+	NET_IFUPDOWN = "ifupdown" // /etc/network/interfaces, gateway set by an init job
+	NET_NETWORKD = "networkd" // systemd-networkd
+	NET_NETPLAN = "netplan"   // /etc/netplan
+	NET_IFCFG = "ifcfg"       // /etc/sysconfig/network-scripts
+	NET_ALPINE = "alpine"     // /etc/network/interfaces, busybox ifupdown
+)
+
+//ID and ID_LIKE from /etc/os-release, debian if unknown
+func detectDistro(rootfs string) string {
+	b, err := ioutil.ReadFile(rootfs + "/etc/os-release")
+	if err != nil {
+		b, err = ioutil.ReadFile(rootfs + "/usr/lib/os-release")
+	}
+	if err != nil {
+		return DISTRO_DEBIAN
+	}
+	ids := []string{}
+	for _, line := range strings.Split(string(b), "\n") {
+		kv := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		if len(kv) == 2 && (kv[0] == "ID" || kv[0] == "ID_LIKE") {
+			ids = append(ids, strings.Fields(strings.Trim(kv[1], "\"'"))...)
+		}
+	}
+	for _, id := range ids {
+		switch id {
+		case "debian", "ubuntu":
+			return DISTRO_DEBIAN
+		case "rhel", "centos", "fedora", "rocky", "almalinux":
+			return DISTRO_RHEL
+		case "alpine":
+			return DISTRO_ALPINE
+		case "arch", "archlinux":
+			return DISTRO_ARCH
+		}
+	}
+	return DISTRO_DEBIAN
+}
+
+func detectInit(rootfs string) string {
+	//merged /usr bases link /sbin to usr/sbin, look at both
+	for _, init := range []string{"/sbin/init", "/usr/sbin/init"} {
+		if target, err := os.Readlink(rootfs + init); err == nil && strings.Contains(target, "systemd") {
+			return INIT_SYSTEMD
+		}
+	}
+	if fileExists(rootfs + "/etc/init") && (fileExists(rootfs + "/sbin/initctl") || fileExists(rootfs + "/usr/sbin/initctl")) {
+		return INIT_UPSTART
+	}
+	if fileExists(rootfs + "/sbin/openrc") {
+		return INIT_OPENRC
+	}
+	if fileExists(rootfs + "/lib/systemd/systemd") || fileExists(rootfs + "/usr/lib/systemd/systemd") {
+		return INIT_SYSTEMD
+	}
+	return INIT_UPSTART
+}
+
+func detectNetworkConfig(rootfs string, distro string, init string) string {
+	switch distro {
+	case DISTRO_RHEL:
+		if fileExists(rootfs + "/etc/sysconfig/network-scripts") {
+			return NET_IFCFG
+		}
+		return NET_NETWORKD
+	case DISTRO_ALPINE:
+		return NET_ALPINE
+	case DISTRO_ARCH:
+		return NET_NETWORKD
+	}
+	if fileExists(rootfs + "/etc/netplan") {
+		return NET_NETPLAN
+	}
+	if init == INIT_SYSTEMD && fileExists(rootfs + "/etc/network/interfaces") == false {
+		return NET_NETWORKD
+	}
+	for _, wants := range []string{"multi-user.target.wants", "network-online.target.wants"} {
+		if fileExists(rootfs + "/etc/systemd/system/" + wants + "/systemd-networkd.service") {
+			return NET_NETWORKD
+		}
+	}
+	return NET_IFUPDOWN
+}
+
+/*
+Guest files, path in the container rootfs -> template. Static ip, gateway and dns are set the way
+the guest distro does it, only ifupdown needs an extra init job for the gateway. Extra interfaces
+get their own file where the guest has one file per interface
+*/
+
+func (c *Container) guestFiles() map[string]string {
+	files := map[string]string{
+		"/etc/hosts": HOSTS_FILE,
+		"/etc/hostname": HOSTNAME_FILE,
+	}
+	switch c.NetworkConfig {
+	case NET_NETWORKD:
+		if c.HasNetwork() {
+			files["/etc/systemd/network/eth0.network"] = NETWORKD_FILE
+		}
+		for index, i := range c.Interfaces {
+			files["/etc/systemd/network/" + i.Name + ".network"] = interfaceTemplate(index, NETWORKD_INTERFACE_FILE)
+		}
+		//DNS= and Domains= are only used by systemd-resolved, linked as resolv.conf when it runs
+		if c.hasDnsConfig() && c.guestResolvConfIsManaged() == false {
+			files["/etc/resolv.conf"] = RESOLV_CONF_FILE
+		}
+	case NET_NETPLAN:
+		//sorted after the base netplan files so ours wins
+		files["/etc/netplan/99-thin-lxc.yaml"] = NETPLAN_FILE
+	case NET_IFCFG:
+		if c.HasNetwork() {
+			files["/etc/sysconfig/network-scripts/ifcfg-eth0"] = IFCFG_FILE
+		}
+		for index, i := range c.Interfaces {
+			files["/etc/sysconfig/network-scripts/ifcfg-" + i.Name] = interfaceTemplate(index, IFCFG_INTERFACE_FILE)
+		}
+		files["/etc/sysconfig/network"] = SYSCONFIG_NETWORK_FILE
+	case NET_ALPINE:
+		files["/etc/network/interfaces"] = ALPINE_INTERFACES_FILE
+		if c.hasDnsConfig() {
+			files["/etc/resolv.conf"] = RESOLV_CONF_FILE
+		}
+	default:
+		files["/etc/network/interfaces"] = INTERFACES_FILE
+		//dns-* lines are only used by resolvconf, guests without it have a plain resolv.conf
+		if c.hasDnsConfig() && c.guestResolvConfIsManaged() == false {
+			files["/etc/resolv.conf"] = RESOLV_CONF_FILE
+		}
+		if c.SetsGateway() == false {
+			break
+		}
+		if c.Init == INIT_SYSTEMD {
+			files["/etc/systemd/system/setup-gateway.service"] = SETUP_GATEWAY_UNIT
+		} else {
+			files["/etc/init/setup-gateway.conf"] = SETUP_GATEWAY_FILE
+		}
+	}
+	return files
+}
+
+func (c *Container) hasDnsConfig() bool {
+	return len(c.Nameservers) > 0 || len(c.DnsSearch) > 0 || len(c.DnsOptions) > 0
+}
+
+//resolv.conf linked to resolvconf / systemd-resolved output
+func (c *Container) guestResolvConfIsManaged() bool {
+	info, err := os.Lstat(c.Rootfs + "/etc/resolv.conf")
+	return err == nil && info.Mode() & os.ModeSymlink != 0
+}
+
+//systemd units enabled in the guest, equivalent of systemctl enable inside the container
+func (c *Container) guestUnits() map[string]string {
+	units := make(map[string]string)
+	if c.Init != INIT_SYSTEMD {
+		return units
+	}
+	if c.NetworkConfig == NET_NETWORKD {
+		units["/etc/systemd/system/multi-user.target.wants/systemd-networkd.service"] = "/lib/systemd/system/systemd-networkd.service"
+	} else if c.SetsGateway() {
+		units["/etc/systemd/system/multi-user.target.wants/setup-gateway.service"] = "/etc/systemd/system/setup-gateway.service"
+	}
+	return units
+}
+
+func (c *Container) enableGuestUnits() error {
+	for link, unit := range c.guestUnits() {
+		if err := os.MkdirAll(path.Dir(c.Rootfs + link), 0755); err != nil {
+			return err
+		}
+		os.Remove(c.Rootfs + link)
+		if err := os.Symlink(unit, c.Rootfs + link); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Guest templates
+*/
+
+//In container: /etc/systemd/system/setup-gateway.service
+const SETUP_GATEWAY_UNIT = `
+[Unit]
+Description=setup gateway
+After=network.target
+
+[Service]
+Type=oneshot
+RemainAfterExit=yes
+ExecStart=/bin/sh -c 'ip route replace default via {{.Gateway}} || route add -net default gw {{.Gateway}}'
+{{if .HasIp6}}
+ExecStart=/bin/sh -c 'ip -6 route replace default via {{.Gateway6}}'
+{{end}}
+
+[Install]
+WantedBy=multi-user.target
+`
+
+//In container: /etc/systemd/network/eth0.network
+const NETWORKD_FILE = `
+[Match]
+Name=eth0
+
+[Network]
+{{if .HasStaticIp}}
+Address={{.IpConfig}}
+Gateway={{.Gateway}}
+{{else}}
+DHCP=ipv4
+{{end}}
+{{if .HasIp6}}
+Address={{.Ip6Config}}
+Gateway={{.Gateway6}}
+{{end}}
+{{range .Nameservers}}
+DNS={{.}}
+{{end}}
+{{if .DnsSearch}}
+Domains={{join .DnsSearch " "}}
+{{end}}
+`
+
+//In container: /etc/systemd/network/<name>.network, extra interfaces, the default route stays on eth0
+const NETWORKD_INTERFACE_FILE = `
+[Match]
+Name={{.Name}}
+
+[Network]
+{{if .HasStaticIp}}
+Address={{.IpConfig}}
+{{else}}
+DHCP=ipv4
+
+[DHCP]
+UseRoutes=false
+UseDNS=false
+{{end}}
+`
+
+//In container: /etc/netplan/99-thin-lxc.yaml
+const NETPLAN_FILE = `
+network:
+  version: 2
+  ethernets:
+{{if .HasNetwork}}
+    eth0:
+{{if .HasStaticIp}}
+      dhcp4: false
+{{else}}
+      dhcp4: true
+{{end}}
+{{if or .HasStaticIp .HasIp6}}
+      addresses: [{{if .HasStaticIp}}{{.IpConfig}}{{end}}{{if and .HasStaticIp .HasIp6}}, {{end}}{{if .HasIp6}}{{.Ip6Config}}{{end}}]
+      routes:
+{{if .HasStaticIp}}
+        - to: 0.0.0.0/0
+          via: {{.Gateway}}
+{{end}}
+{{if .HasIp6}}
+        - to: "::/0"
+          via: {{.Gateway6}}
+{{end}}
+{{end}}
+{{if or .Nameservers .DnsSearch}}
+      nameservers:
+        addresses: [{{join .Nameservers ", "}}]
+        search: [{{join .DnsSearch ", "}}]
+{{end}}
+{{end}}
+{{range .Interfaces}}
+    {{.Name}}:
+{{if .HasStaticIp}}
+      dhcp4: false
+      addresses: [{{.IpConfig}}]
+{{else}}
+      dhcp4: true
+      dhcp4-overrides:
+        use-routes: false
+{{end}}
+{{end}}
+`
+
+//In container: /etc/sysconfig/network-scripts/ifcfg-eth0
+const IFCFG_FILE = `
+DEVICE=eth0
+TYPE=Ethernet
+ONBOOT=yes
+{{if .HasStaticIp}}
+BOOTPROTO=none
+IPADDR={{.Ip}}
+PREFIX={{.PrefixLength}}
+GATEWAY={{.Gateway}}
+{{else}}
+BOOTPROTO=dhcp
+{{end}}
+{{if .HasIp6}}
+IPV6INIT=yes
+IPV6ADDR={{.Ip6Config}}
+IPV6_DEFAULTGW={{.Gateway6}}
+{{end}}
+{{range $i, $ns := .Nameservers}}
+DNS{{inc $i}}={{$ns}}
+{{end}}
+{{if .DnsSearch}}
+DOMAIN="{{join .DnsSearch " "}}"
+{{end}}
+{{if .DnsOptions}}
+RES_OPTIONS="{{join .DnsOptions " "}}"
+{{end}}
+`
+
+//In container: /etc/sysconfig/network-scripts/ifcfg-<name>, extra interfaces
+const IFCFG_INTERFACE_FILE = `
+DEVICE={{.Name}}
+TYPE=Ethernet
+ONBOOT=yes
+DEFROUTE=no
+{{if .HasStaticIp}}
+BOOTPROTO=none
+IPADDR={{.Ip}}
+PREFIX={{.PrefixLength}}
+{{else}}
+BOOTPROTO=dhcp
+PEERDNS=no
+{{end}}
+`
+
+//In container: /etc/sysconfig/network
+const SYSCONFIG_NETWORK_FILE = `
+NETWORKING=yes
+HOSTNAME={{.HostName}}
+{{if .HasStaticIp}}
+GATEWAY={{.Gateway}}
+{{end}}
+`
+
+//In container: /etc/network/interfaces (alpine)
+const ALPINE_INTERFACES_FILE = `
+auto lo
+iface lo inet loopback
+{{if .HasNetwork}}
+auto eth0
+{{if .HasStaticIp}}
+iface eth0 inet static
+	address {{.Ip}}
+	netmask {{.Netmask}}
+	gateway {{.Gateway}}
+{{else}}
+iface eth0 inet dhcp
+	hostname {{.HostName}}
+{{end}}
+{{if .HasIp6}}
+iface eth0 inet6 static
+	address {{.Ip6}}
+	netmask {{.Ip6PrefixLength}}
+	gateway {{.Gateway6}}
+{{end}}
+{{end}}
+{{range .Interfaces}}
+auto {{.Name}}
+{{if .HasStaticIp}}
+iface {{.Name}} inet static
+	address {{.Ip}}
+	netmask {{.Netmask}}
+{{else}}
+iface {{.Name}} inet dhcp
+{{end}}
+{{end}}
+`
+
+//In container: /etc/resolv.conf
+const RESOLV_CONF_FILE = `
+{{range .Nameservers}}
+nameserver {{.}}
+{{end}}
+{{if .DnsSearch}}
+search {{join .DnsSearch " "}}
+{{end}}
+{{if .DnsOptions}}
+options {{join .DnsOptions " "}}
+{{end}}
+`
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func Test_detectInit(t *testing.T) {
+	fmt.Print("Testing guest init system detection ... ")
+	rootfs, _ := ioutil.TempDir("", "thin-lxc-rootfs")
+	defer os.RemoveAll(rootfs)
+
+	//precise like base
+	os.MkdirAll(rootfs+"/etc/init", 0755)
+	os.MkdirAll(rootfs+"/etc/network", 0755)
+	os.MkdirAll(rootfs+"/sbin", 0755)
+	ioutil.WriteFile(rootfs+"/sbin/initctl", []byte{}, 0755)
+	ioutil.WriteFile(rootfs+"/etc/network/interfaces", []byte{}, 0644)
+	if init := detectInit(rootfs); init != INIT_UPSTART {
+		failTest(t, "expected upstart, got", init)
+	}
+	c := &Container{Init: INIT_UPSTART, NetworkConfig: detectNetworkConfig(rootfs, DISTRO_DEBIAN, INIT_UPSTART)}
+	if _, ok := c.guestFiles()["/etc/init/setup-gateway.conf"]; ok == false {
+		failTest(t, "upstart guest should get the upstart gateway job")
+	}
+
+	//systemd base still using ifupdown
+	os.Symlink("/lib/systemd/systemd", rootfs+"/sbin/init")
+	init := detectInit(rootfs)
+	if init != INIT_SYSTEMD {
+		failTest(t, "expected systemd, got", init)
+	}
+	c = &Container{Init: init, NetworkConfig: detectNetworkConfig(rootfs, DISTRO_DEBIAN, init)}
+	if _, ok := c.guestFiles()["/etc/systemd/system/setup-gateway.service"]; ok == false || c.NetworkConfig != NET_IFUPDOWN {
+		failTest(t, "systemd guest should get the gateway unit", c.NetworkConfig)
+	}
+	if _, ok := c.guestUnits()["/etc/systemd/system/multi-user.target.wants/setup-gateway.service"]; ok == false {
+		failTest(t, "gateway unit not enabled")
+	}
+
+	//systemd-networkd base
+	os.RemoveAll(rootfs + "/etc/network")
+	c = &Container{Init: init, NetworkConfig: detectNetworkConfig(rootfs, DISTRO_DEBIAN, init)}
+	if _, ok := c.guestFiles()["/etc/systemd/network/eth0.network"]; ok == false || c.NetworkConfig != NET_NETWORKD {
+		failTest(t, "networkd guest should get a .network file", c.NetworkConfig)
+	}
+	fmt.Println("OK")
+}
+
+func Test_guestNetworkConfig(t *testing.T) {
+	fmt.Print("Testing distro aware guest network configuration ... ")
+	rootfs, _ := ioutil.TempDir("", "thin-lxc-rootfs")
+	defer os.RemoveAll(rootfs)
+	os.MkdirAll(rootfs+"/etc/sysconfig/network-scripts", 0755)
+	ioutil.WriteFile(rootfs+"/etc/os-release", []byte("NAME=\"CentOS Linux\"\nID=\"centos\"\nID_LIKE=\"rhel fedora\"\n"), 0644)
+
+	distro := detectDistro(rootfs)
+	if distro != DISTRO_RHEL {
+		failTest(t, "expected rhel, got", distro)
+	}
+	c := &Container{
+		Rootfs: rootfs,
+		HostName: "web",
+		Ip: "10.0.3.12",
+		Subnet: DEFAULT_SUBNET,
+		Gateway: DEFAULT_GATEWAY,
+		Nameservers: []string{"10.0.3.1", "8.8.8.8"},
+		Distro: distro,
+		NetworkConfig: detectNetworkConfig(rootfs, distro, INIT_SYSTEMD),
+	}
+	for path, template := range c.guestFiles() {
+		if err := c.executeTemplate(template, rootfs+path); err != nil {
+			failTest(t, "unable to render", path, err)
+		}
+	}
+	b, _ := ioutil.ReadFile(rootfs + "/etc/sysconfig/network-scripts/ifcfg-eth0")
+	for _, line := range []string{"IPADDR=10.0.3.12", "PREFIX=24", "GATEWAY=10.0.3.1", "DNS1=10.0.3.1", "DNS2=8.8.8.8"} {
+		if strings.Contains(string(b), line) == false {
+			failTest(t, "ifcfg-eth0 is missing", line, string(b))
+		}
+	}
+
+	c.NetworkConfig = NET_ALPINE
+	if err := c.executeTemplate(ALPINE_INTERFACES_FILE, rootfs+"/etc/network/interfaces"); err != nil {
+		failTest(t, "unable to render alpine interfaces", err)
+	}
+	b, _ = ioutil.ReadFile(rootfs + "/etc/network/interfaces")
+	if strings.Contains(string(b), "netmask 255.255.255.0") == false {
+		failTest(t, "alpine interfaces missing netmask", string(b))
+	}
+	fmt.Println("OK")
+}
+
+func Test_guestDnsConfig(t *testing.T) {
+	fmt.Print("Testing guest dns configuration ... ")
+	rootfs, _ := ioutil.TempDir("", "thin-lxc-rootfs")
+	defer os.RemoveAll(rootfs)
+	os.MkdirAll(rootfs+"/etc", 0755)
+	ioutil.WriteFile(rootfs+"/etc/resolv.conf", []byte("nameserver 10.0.3.1\n"), 0644)
+
+	c := &Container{
+		Rootfs: rootfs,
+		NetworkConfig: NET_IFUPDOWN,
+		Nameservers: []string{"10.0.3.1"},
+		DnsSearch: []string{"internal.example.com", "example.com"},
+		DnsOptions: []string{"ndots:2"},
+	}
+	template, ok := c.guestFiles()["/etc/resolv.conf"]
+	if ok == false {
+		failTest(t, "plain resolv.conf should be rendered")
+	}
+	c.executeTemplate(template, rootfs+"/etc/resolv.conf")
+	b, _ := ioutil.ReadFile(rootfs + "/etc/resolv.conf")
+	for _, line := range []string{"nameserver 10.0.3.1", "search internal.example.com example.com", "options ndots:2"} {
+		if strings.Contains(string(b), line) == false {
+			failTest(t, "resolv.conf is missing", line, string(b))
+		}
+	}
+
+	//resolvconf managed guests get dns-* lines in interfaces, resolv.conf is left alone
+	os.Remove(rootfs + "/etc/resolv.conf")
+	os.Symlink("/run/resolvconf/resolv.conf", rootfs+"/etc/resolv.conf")
+	if _, ok := c.guestFiles()["/etc/resolv.conf"]; ok {
+		failTest(t, "managed resolv.conf should not be rendered")
+	}
+	c.executeTemplate(INTERFACES_FILE, rootfs+"/etc/network/interfaces")
+	b, _ = ioutil.ReadFile(rootfs + "/etc/network/interfaces")
+	if strings.Contains(string(b), "dns-search internal.example.com example.com") == false {
+		failTest(t, "interfaces is missing dns-search", string(b))
+	}
+
+	//networkd, DNS= only works with systemd-resolved (resolv.conf linked to its stub)
+	c.NetworkConfig = NET_NETWORKD
+	c.Ip = "10.0.3.12"
+	os.Remove(rootfs + "/etc/resolv.conf")
+	os.Symlink("/run/systemd/resolve/stub-resolv.conf", rootfs+"/etc/resolv.conf")
+	if _, ok := c.guestFiles()["/etc/resolv.conf"]; ok {
+		failTest(t, "resolved managed resolv.conf should not be rendered")
+	}
+	os.Remove(rootfs + "/etc/resolv.conf")
+	ioutil.WriteFile(rootfs+"/etc/resolv.conf", []byte("nameserver 8.8.8.8\n"), 0644)
+	if _, ok := c.guestFiles()["/etc/resolv.conf"]; ok == false {
+		failTest(t, "plain resolv.conf of networkd guests should be rendered")
+	}
+	fmt.Println("OK")
+}
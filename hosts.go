@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+const HOSTS_PATH = "/etc/hosts"
+
+const HOSTS_BLOCK_BEGIN = "# BEGIN thin-lxc (managed, do not edit)"
+const HOSTS_BLOCK_END = "# END thin-lxc"
+
+/*
+Name resolution between host and containers. The registry is built from every container metadata,
+it is written to a managed block of the host hosts file (host -> container) and to /etc/hosts of
+every mounted container (container -> container, container -> host).
+*/
+
+type hostEntry struct {
+	Ip    string
+	Names []string
+}
+
+//nil until syncHosts runs, Peers() then loads it
+var registry []hostEntry
+
+func hostEntries(containers []*Container) []hostEntry {
+	entries := []hostEntry{}
+	for _, c := range containers {
+		if len(c.Address()) == 0 {
+			continue
+		}
+		names := []string{c.HostName}
+		if c.Name != c.HostName {
+			names = append(names, c.Name)
+		}
+		entries = append(entries, hostEntry{c.Address(), names})
+		if c.HasIp6() {
+			entries = append(entries, hostEntry{c.Ip6, names})
+		}
+	}
+	sort.Stable(byName(entries))
+	return entries
+}
+
+type byName []hostEntry
+
+func (a byName) Len() int           { return len(a) }
+func (a byName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byName) Less(i, j int) bool { return a[i].Names[0] < a[j].Names[0] }
+
+//ip containers are reachable at, static or reserved in dnsmasq, empty if unknown
+func (c *Container) Address() string {
+	if c.HasStaticIp() {
+		return c.Ip
+	}
+	return c.LeaseIp
+}
+
+//other containers, used by HOSTS_FILE
+func (c *Container) Peers() []hostEntry {
+	if registry == nil {
+		containers, err := listAllContainers()
+		if err != nil {
+			return nil
+		}
+		registry = hostEntries(containers)
+	}
+	peers := []hostEntry{}
+	for _, entry := range registry {
+		if entry.Names[0] != c.HostName && entry.Ip != c.Address() {
+			peers = append(peers, entry)
+		}
+	}
+	return peers
+}
+
+//host name as seen from containers (resolves to the gateway), used by HOSTS_FILE
+func (c *Container) HostHostName() string {
+	name, err := os.Hostname()
+	if err != nil || name == c.HostName {
+		return ""
+	}
+	return name
+}
+
+func (c *Container) hostsTemplate() (string, error) {
+	templates, err := c.userTemplates()
+	if err != nil {
+		return "", err
+	}
+	if t, ok := templates["/etc/hosts"]; ok {
+		return t.content, nil
+	}
+	return HOSTS_FILE, nil
+}
+
+//to run after every create, destroy and reload
+func syncHosts() {
+	containers, err := listAllContainers()
+	if err != nil {
+		log.Println("Unable to update hosts", err)
+		return
+	}
+	//first, it reserves addresses of new DHCP containers
+	if err := syncDnsmasq(containers); err != nil {
+		log.Println("Unable to update dnsmasq", err)
+	}
+	registry = hostEntries(containers)
+
+	if err := updateHostsBlock(config.HostsFile, registry); err != nil {
+		log.Println("Unable to update", config.HostsFile, err)
+	}
+	for _, c := range containers {
+		if c.isMounted() == false {
+			continue
+		}
+		template, err := c.hostsTemplate()
+		if err == nil {
+			err = c.executeTemplate(template, c.Rootfs + "/etc/hosts")
+		}
+		if err != nil {
+			log.Println("Unable to update /etc/hosts of", c.Name, err)
+		}
+	}
+}
+
+//replace (or append) the thin-lxc block, leaving the rest of the file untouched
+func updateHostsBlock(path string, entries []hostEntry) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil && os.IsNotExist(err) == false {
+		return err
+	}
+	content := string(b)
+	if begin := strings.Index(content, HOSTS_BLOCK_BEGIN); begin >= 0 {
+		end := strings.Index(content[begin:], HOSTS_BLOCK_END)
+		if end < 0 {
+			end = len(content) - begin
+		} else {
+			end += len(HOSTS_BLOCK_END)
+		}
+		content = content[:begin] + strings.TrimLeft(content[begin + end:], "\n")
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(content)
+	if len(entries) > 0 {
+		if len(content) > 0 && strings.HasSuffix(content, "\n") == false {
+			buf.WriteString("\n")
+		}
+		buf.WriteString(HOSTS_BLOCK_BEGIN + "\n")
+		for _, entry := range entries {
+			buf.WriteString(entry.Ip + " " + strings.Join(entry.Names, " ") + "\n")
+		}
+		buf.WriteString(HOSTS_BLOCK_END + "\n")
+	}
+	if buf.String() == string(b) {
+		return nil
+	}
+	//in place, /etc/hosts may be a bind mount
+	return ioutil.WriteFile(path, buf.Bytes(), 0644)
+}
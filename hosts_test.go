@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func Test_updateHostsBlock(t *testing.T) {
+	fmt.Print("Testing host hosts file update ... ")
+	f, _ := ioutil.TempFile("", "thin-lxc-hosts")
+	defer os.Remove(f.Name())
+	f.WriteString("127.0.0.1 localhost\n::1 ip6-localhost")
+	f.Close()
+
+	containers := []*Container{
+		{Name: "web", HostName: "web", Ip: "10.0.3.12"},
+		{Name: "db", HostName: "postgres", Ip: "10.0.3.13"},
+		{Name: "worker", HostName: "worker"}, //dhcp, unknown address
+	}
+	entries := hostEntries(containers)
+	if len(entries) != 2 || entries[0].Names[0] != "postgres" || entries[0].Names[1] != "db" {
+		failTest(t, "wrong host entries", entries)
+	}
+
+	expected := "127.0.0.1 localhost\n::1 ip6-localhost\n" + HOSTS_BLOCK_BEGIN + "\n10.0.3.13 postgres db\n10.0.3.12 web\n" + HOSTS_BLOCK_END + "\n"
+	for i := 0; i < 2; i++ { //idempotent
+		if err := updateHostsBlock(f.Name(), entries); err != nil {
+			failTest(t, "update failed", err)
+		}
+		if b, _ := ioutil.ReadFile(f.Name()); string(b) != expected {
+			failTest(t, "unexpected hosts file", string(b))
+		}
+	}
+
+	updateHostsBlock(f.Name(), nil)
+	if b, _ := ioutil.ReadFile(f.Name()); string(b) != "127.0.0.1 localhost\n::1 ip6-localhost\n" {
+		failTest(t, "block not removed", string(b))
+	}
+
+	registry = entries
+	defer func() { registry = nil }()
+	peers := containers[0].Peers()
+	if len(peers) != 1 || peers[0].Ip != "10.0.3.13" {
+		failTest(t, "peers should not include the container itself", peers)
+	}
+	fmt.Println("OK")
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+//Xen OUI, the one LXC uses
+const HWADDR_PREFIX = "00:16:3e"
+
+/*
+Mac addresses are derived from the container name and the host id, so they are stable across
+recreations of a container and differ between hosts sharing a network
+*/
+
+func hostId() string {
+	for _, path := range []string{"/etc/machine-id", "/var/lib/dbus/machine-id"} {
+		if b, err := ioutil.ReadFile(path); err == nil && len(strings.TrimSpace(string(b))) > 0 {
+			return strings.TrimSpace(string(b))
+		}
+	}
+	name, _ := os.Hostname()
+	return name
+}
+
+func hwaddrTaken(hwaddr string, name string, containers []*Container) string {
+	for _, other := range containers {
+		if other.Name == name {
+			continue
+		}
+		if strings.EqualFold(other.Hwaddr, hwaddr) {
+			return other.Name
+		}
+		for _, i := range other.Interfaces {
+			if strings.EqualFold(i.Hwaddr, hwaddr) {
+				return other.Name
+			}
+		}
+	}
+	return ""
+}
+
+func stableHwaddr(name string, host string, containers []*Container) string {
+	seed := host + "/" + name
+	for i := 0; ; i++ {
+		sum := sha1.Sum([]byte(seed))
+		hwaddr := fmt.Sprintf("%s:%02x:%02x:%02x", HWADDR_PREFIX, sum[0], sum[1], sum[2])
+		if hwaddrTaken(hwaddr, name, containers) == "" {
+			return hwaddr
+		}
+		//collision, rehash
+		seed = host + "/" + name + "/" + strconv.Itoa(i)
+	}
+}
+
+//-hw
+func (c *Container) setHwaddr(hwaddr string, containers []*Container) error {
+	mac, err := net.ParseMAC(hwaddr)
+	if err != nil || len(mac) != 6 {
+		return errors.New("Invalid mac address " + hwaddr)
+	}
+	if mac[0]&1 != 0 {
+		return errors.New(hwaddr + " is a multicast mac address")
+	}
+	if other := hwaddrTaken(mac.String(), c.Name, containers); len(other) > 0 {
+		return errors.New(hwaddr + " already used by " + other)
+	}
+	c.Hwaddr = mac.String()
+	return nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func Test_stableHwaddr(t *testing.T) {
+	fmt.Print("Testing mac address generation ... ")
+	hw := stableHwaddr("web", "host-a", nil)
+	if strings.HasPrefix(hw, HWADDR_PREFIX+":") == false || len(hw) != 17 {
+		failTest(t, "wrong mac address format", hw)
+	}
+	if stableHwaddr("web", "host-a", nil) != hw {
+		failTest(t, "mac address should be stable")
+	}
+	if stableHwaddr("web", "host-b", nil) == hw || stableHwaddr("db", "host-a", nil) == hw {
+		failTest(t, "mac address should depend on name and host")
+	}
+
+	//collision with an existing container
+	existing := []*Container{{Name: "other", Hwaddr: strings.ToUpper(hw)}}
+	if rehashed := stableHwaddr("web", "host-a", existing); rehashed == hw || strings.HasPrefix(rehashed, HWADDR_PREFIX) == false {
+		failTest(t, "collision not avoided", rehashed)
+	}
+
+	c := &Container{Name: "web"}
+	if err := c.setHwaddr(hw, existing); err == nil {
+		failTest(t, "explicit mac address already in use should fail")
+	}
+	if err := c.setHwaddr("01:16:3e:00:00:01", nil); err == nil {
+		failTest(t, "multicast mac address should fail")
+	}
+	if err := c.setHwaddr("00:16:3E:AA:BB:CC", existing); err != nil || c.Hwaddr != "00:16:3e:aa:bb:cc" {
+		failTest(t, "explicit mac address not set", c.Hwaddr, err)
+	}
+	fmt.Println("OK")
+}
@@ -8,8 +8,9 @@ echo "Downloading sources"
 curl -sL https://github.com/robinmonjo/thin-lxc/archive/v$VERSION.tar.gz | tar -C /tmp -zxf - &> /dev/null
 
 echo "Building ..."
-go build /tmp/thin-lxc-$VERSION/thin-lxc.go
-sudo mv thin-lxc /usr/local/bin
+(cd /tmp/thin-lxc-$VERSION && go build -o thin-lxc $(ls *.go | grep -v _test.go | grep -v _liblxc.go))
+sudo mv /tmp/thin-lxc-$VERSION/thin-lxc /usr/local/bin
+sudo ln -sf /usr/local/bin/thin-lxc /usr/local/bin/thin-lxcd
 
 echo "Cleaning up ..."
 rm -rf /tmp/thin-lxc*
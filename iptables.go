@@ -0,0 +1,410 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"log"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+//chains owned by thin-lxc
+const NAT_CHAIN = "THIN-LXC"
+const NAT_POSTROUTING_CHAIN = "THIN-LXC-POSTROUTING"
+const FILTER_CHAIN = "THIN-LXC-FORWARD"
+const INPUT_CHAIN = "THIN-LXC-INPUT"
+const CONTAINER_CHAIN_PREFIX = "THIN-LXC-CT-"
+
+/*
+Every rule thin-lxc adds lives in its own chains, so they never mix with the host ones and can be
+flushed at once (-a flush):
+
+nat PREROUTING, OUTPUT (destination is a host address) -> THIN-LXC: DNAT of published ports
+nat POSTROUTING -> THIN-LXC-POSTROUTING: hairpin, masquerade containers (and the host over
+loopback) reaching a published port so replies come back through the host
+filter FORWARD -> THIN-LXC-FORWARD -> THIN-LXC-CT-<name>: firewall policies, a chain per container
+filter INPUT -> THIN-LXC-INPUT: drops what containers send to loopback addresses (route_localnet)
+
+The same chains exist in ip6tables.
+*/
+
+type chainJump struct {
+	table string
+	from string
+	chain string
+	args []string //match of the jump rule
+}
+
+var chainJumps = []chainJump{
+	{"nat", "PREROUTING", NAT_CHAIN, []string{"-m", "addrtype", "--dst-type", "LOCAL"}},
+	{"nat", "OUTPUT", NAT_CHAIN, []string{"-m", "addrtype", "--dst-type", "LOCAL"}},
+	{"nat", "POSTROUTING", NAT_POSTROUTING_CHAIN, nil},
+	{"filter", "FORWARD", FILTER_CHAIN, nil},
+	{"filter", "INPUT", INPUT_CHAIN, nil},
+}
+
+func concat(args ...[]string) []string {
+	all := []string{}
+	for _, a := range args {
+		all = append(all, a...)
+	}
+	return all
+}
+
+func iptablesDo(bin string, table string, action string, chain string, rule []string) error {
+	cmd := exec.Command(bin, concat([]string{"-t", table, action, chain}, rule)...)
+	return runCmdWithDetailedError(cmd)
+}
+
+//create the chains and jump to them, once
+func ensureChains(bin string) error {
+	for _, jump := range chainJumps {
+		if runCmdWithDetailedError(exec.Command(bin, "-t", jump.table, "-n", "-L", jump.chain)) != nil {
+			if err := runCmdWithDetailedError(exec.Command(bin, "-t", jump.table, "-N", jump.chain)); err != nil {
+				return err
+			}
+		}
+		rule := concat(jump.args, []string{"-j", jump.chain})
+		if iptablesDo(bin, jump.table, "-C", jump.from, rule) == nil {
+			continue
+		}
+		if err := iptablesDo(bin, jump.table, "-I", jump.from, concat([]string{"1"}, rule)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//remove every rule and chain thin-lxc owns
+func flushChains(bin string) error {
+	for _, jump := range chainJumps {
+		rule := concat(jump.args, []string{"-j", jump.chain})
+		for iptablesDo(bin, jump.table, "-C", jump.from, rule) == nil {
+			if err := iptablesDo(bin, jump.table, "-D", jump.from, rule); err != nil {
+				return err
+			}
+		}
+		if runCmdWithDetailedError(exec.Command(bin, "-t", jump.table, "-n", "-L", jump.chain)) != nil {
+			continue
+		}
+		if err := runCmdWithDetailedError(exec.Command(bin, "-t", jump.table, "-F", jump.chain)); err != nil {
+			return err
+		}
+		if err := runCmdWithDetailedError(exec.Command(bin, "-t", jump.table, "-X", jump.chain)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+nat rules of the published port: DNAT, then masquerade for clients of the subnet (other
+containers, the container itself) and, ipv4 only, for the host over loopback
+*/
+func (c *Container) natRules(ip string, subnet string, dest string) [][]string {
+	port := strconv.Itoa(c.Port)
+	rules := [][]string{
+		{NAT_CHAIN, "-p", "tcp", "--dport", strconv.Itoa(c.HostPort), "-j", "DNAT", "--to-destination", dest},
+		{NAT_POSTROUTING_CHAIN, "-s", subnet, "-d", ip, "-p", "tcp", "--dport", port, "-j", "MASQUERADE"},
+	}
+	if ip == c.Address() {
+		rules = append(rules, []string{NAT_POSTROUTING_CHAIN, "-s", "127.0.0.0/8", "-d", ip, "-p", "tcp", "--dport", port, "-j", "MASQUERADE"})
+	}
+	return rules
+}
+
+//-A adds missing rules, -D removes present ones, -C checks them all
+func natRulesDo(bin string, action string, rules [][]string) error {
+	for _, rule := range rules {
+		err := iptablesDo(bin, "nat", "-C", rule[0], rule[1:])
+		exists := err == nil
+		switch {
+		case action == "-C" && exists == false:
+			return err
+		case action == "-C", action == "-A" && exists, action == "-D" && exists == false:
+			continue
+		}
+		if err := iptablesDo(bin, "nat", action, rule[0], rule[1:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+DNAT from loopback (host clients of localhost:HostPort) is dropped unless the bridge allows it. It
+also lets containers reach host services only listening on loopback (CVE-2020-8558), the backends
+drop packets from the bridge to 127.0.0.0/8 that weren't DNATed before turning it on.
+*/
+func enableRouteLocalnet(bridge string) error {
+	return ioutil.WriteFile("/proc/sys/net/ipv4/conf/" + bridge + "/route_localnet", []byte("1\n"), 0644)
+}
+
+//once the drops are flushed
+func disableRouteLocalnet(bridge string) error {
+	return ioutil.WriteFile("/proc/sys/net/ipv4/conf/" + bridge + "/route_localnet", []byte("0\n"), 0644)
+}
+
+func localnetRule(bridge string) []string {
+	return []string{"-i", bridge, "-d", "127.0.0.0/8", "-m", "conntrack", "!", "--ctstate", "DNAT", "-j", "DROP"}
+}
+
+func ensureLocalnetRule(bridge string) error {
+	if iptablesDo("iptables", "filter", "-C", INPUT_CHAIN, localnetRule(bridge)) == nil {
+		return nil
+	}
+	return iptablesDo("iptables", "filter", "-A", INPUT_CHAIN, localnetRule(bridge))
+}
+
+//rule of thin-lxc <= 0.4, straight in PREROUTING, removed by destroy and flush
+func (c *Container) legacyIptablesRule() []string {
+	return []string{"-p", "tcp", "!", "-s", c.Subnet, "--dport", strconv.Itoa(c.HostPort), "-j", "DNAT", "--to-destination", c.Ip + ":" + strconv.Itoa(c.Port)}
+}
+
+func (c *Container) removeLegacyIptablesRule() error {
+	if c.HostPort == 0 || iptablesDo("iptables", "nat", "-C", "PREROUTING", c.legacyIptablesRule()) != nil {
+		return nil
+	}
+	return iptablesDo("iptables", "nat", "-D", "PREROUTING", c.legacyIptablesRule())
+}
+
+type iptablesBackend struct{}
+
+//rules in the thin-lxc chains, to the static ip or the dnsmasq lease
+func (c *Container) iptablesRuleDo(action string) error {
+	return natRulesDo("iptables", action, c.natRules(c.Address(), c.Subnet, c.Address() + ":" + strconv.Itoa(c.Port)))
+}
+
+func (c *Container) ip6tablesRuleDo(action string) error {
+	return natRulesDo("ip6tables", action, c.natRules(c.Ip6, c.Subnet6, "[" + c.Ip6 + "]:" + strconv.Itoa(c.Port)))
+}
+
+func (c *Container) iptablesRuleExists() bool {
+	return c.iptablesRuleDo("-C") == nil
+}
+
+func (c *Container) ip6tablesRuleExists() bool {
+	return c.ip6tablesRuleDo("-C") == nil
+}
+
+func (b iptablesBackend) forwardPort(c *Container) error {
+	if err := ensureChains("iptables"); err != nil {
+		return err
+	}
+	//hosts forwarding ports before the drop existed get it on reload
+	if err := ensureLocalnetRule(c.Bridge); err != nil {
+		return err
+	}
+	if c.iptablesRuleExists() {
+		return errors.New("Trying to add iptables rule that already exists")
+	}
+	if err := enableRouteLocalnet(c.Bridge); err != nil {
+		return err
+	}
+	if err := c.iptablesRuleDo("-A"); err != nil {
+		return err
+	}
+	if c.HasIp6() == false {
+		return nil
+	}
+	if err := ensureChains("ip6tables"); err != nil {
+		return err
+	}
+	if c.ip6tablesRuleExists() {
+		return errors.New("Trying to add ip6tables rule that already exists")
+	}
+	return c.ip6tablesRuleDo("-A")
+}
+
+//-D only removes the rules present
+func (b iptablesBackend) unforwardPort(c *Container) error {
+	if err := c.removeLegacyIptablesRule(); err != nil {
+		return err
+	}
+	if err := c.iptablesRuleDo("-D"); err != nil {
+		return err
+	}
+	if c.HasIp6() {
+		return c.ip6tablesRuleDo("-D")
+	}
+	return nil
+}
+
+func (b iptablesBackend) portForwarded(c *Container) bool {
+	return c.iptablesRuleExists()
+}
+
+func iptablesBin(ip6 bool) string {
+	if ip6 {
+		return "ip6tables"
+	}
+	return "iptables"
+}
+
+//28 characters max, long names are shortened with a hash
+func (c *Container) firewallChain() string {
+	name := c.Name
+	if max := 28 - len(CONTAINER_CHAIN_PREFIX); len(name) > max {
+		h := fnv.New32a()
+		h.Write([]byte(name))
+		name = fmt.Sprintf("%s-%08x", name[:max-9], h.Sum32())
+	}
+	return CONTAINER_CHAIN_PREFIX + name
+}
+
+//traffic coming from the container
+func (c *Container) fromContainer(ip6 bool) []string {
+	if len(c.VethPair) > 0 {
+		return []string{"-m", "physdev", "--physdev-in", c.VethPair}
+	}
+	return []string{"-s", c.policyAddress(ip6)}
+}
+
+//rules of the container chain in order, without the chain
+func (c *Container) firewallRules(ip6 bool) [][]string {
+	rules := [][]string{}
+	for _, r := range c.policyRules(ip6) {
+		rule, peer := []string{"-d", c.policyAddress(ip6)}, "-s"
+		if r.egress {
+			rule, peer = c.fromContainer(ip6), "-d"
+		}
+		if len(r.peer) > 0 {
+			rule = append(rule, peer, r.peer)
+		}
+		if r.port > 0 {
+			rule = append(rule, "-p", r.proto, "--dport", strconv.Itoa(r.port))
+		}
+		if len(r.state) > 0 {
+			rule = append(rule, "-m", "conntrack", "--ctstate", r.state)
+		}
+		rules = append(rules, append(rule, "-j", r.verdict))
+	}
+	return rules
+}
+
+//THIN-LXC-FORWARD rules, to and from the container
+func (c *Container) firewallJumps(ip6 bool) [][]string {
+	if c.Firewall.isEmpty() {
+		return nil
+	}
+	return [][]string{
+		{"-d", c.policyAddress(ip6), "-j", c.firewallChain()},
+		append(c.fromContainer(ip6), "-j", c.firewallChain()),
+	}
+}
+
+func filterChainExists(bin string, chain string) bool {
+	return runCmdWithDetailedError(exec.Command(bin, "-t", "filter", "-n", "-L", chain)) == nil
+}
+
+//the container chain is rebuilt unless every rule is there, as their order matters
+func (c *Container) applyFirewallRules(bin string, ip6 bool) error {
+	if err := ensureChains(bin); err != nil {
+		return err
+	}
+	chain := c.firewallChain()
+	if filterChainExists(bin, chain) == false {
+		if err := runCmdWithDetailedError(exec.Command(bin, "-t", "filter", "-N", chain)); err != nil {
+			return err
+		}
+	}
+	rules := c.firewallRules(ip6)
+	for _, rule := range rules {
+		if iptablesDo(bin, "filter", "-C", chain, rule) == nil {
+			continue
+		}
+		if err := runCmdWithDetailedError(exec.Command(bin, "-t", "filter", "-F", chain)); err != nil {
+			return err
+		}
+		for _, rule := range rules {
+			if err := iptablesDo(bin, "filter", "-A", chain, rule); err != nil {
+				return err
+			}
+		}
+		break
+	}
+	for _, jump := range c.firewallJumps(ip6) {
+		if iptablesDo(bin, "filter", "-C", FILTER_CHAIN, jump) == nil {
+			continue
+		}
+		if err := iptablesDo(bin, "filter", "-A", FILTER_CHAIN, jump); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b iptablesBackend) applyPolicy(c *Container) error {
+	for _, ip6 := range c.policyFamilies() {
+		if err := c.applyFirewallRules(iptablesBin(ip6), ip6); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//jumps first, then the chain
+func (b iptablesBackend) removePolicy(c *Container) error {
+	for _, ip6 := range c.policyFamilies() {
+		bin, chain := iptablesBin(ip6), c.firewallChain()
+		if filterChainExists(bin, chain) == false {
+			continue
+		}
+		for _, jump := range c.firewallJumps(ip6) {
+			for iptablesDo(bin, "filter", "-C", FILTER_CHAIN, jump) == nil {
+				if err := iptablesDo(bin, "filter", "-D", FILTER_CHAIN, jump); err != nil {
+					return err
+				}
+			}
+		}
+		if err := runCmdWithDetailedError(exec.Command(bin, "-t", "filter", "-F", chain)); err != nil {
+			return err
+		}
+		if err := runCmdWithDetailedError(exec.Command(bin, "-t", "filter", "-X", chain)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//container chains, once THIN-LXC-FORWARD and its jumps to them are gone
+func flushContainerChains(bin string) error {
+	out, err := exec.Command(bin, "-t", "filter", "-S").Output()
+	if err != nil {
+		//no such command or table, nothing to flush
+		return nil
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(line, "-N " + CONTAINER_CHAIN_PREFIX) == false {
+			continue
+		}
+		chain := strings.TrimPrefix(line, "-N ")
+		if err := runCmdWithDetailedError(exec.Command(bin, "-t", "filter", "-F", chain)); err != nil {
+			return err
+		}
+		if err := runCmdWithDetailedError(exec.Command(bin, "-t", "filter", "-X", chain)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b iptablesBackend) flush(containers []*Container) error {
+	for _, c := range containers {
+		if err := c.removeLegacyIptablesRule(); err != nil {
+			log.Println("Unable to remove the rule of", c.Name, err)
+		}
+	}
+	for _, bin := range []string{"iptables", "ip6tables"} {
+		if err := flushChains(bin); err != nil {
+			return err
+		}
+		if err := flushContainerChains(bin); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func Test_natRules(t *testing.T) {
+	fmt.Print("Testing published port rules ... ")
+	c := &Container{Name: "web", Ip: "10.0.3.12", Subnet: DEFAULT_SUBNET, Ip6: "fd00:10:0:3::12", Subnet6: "fd00:10:0:3::/64", Port: 80, HostPort: 8080}
+	rules := []string{}
+	for _, rule := range c.natRules(c.Ip, c.Subnet, "10.0.3.12:80") {
+		rules = append(rules, strings.Join(rule, " "))
+	}
+	expected := []string{
+		"THIN-LXC -p tcp --dport 8080 -j DNAT --to-destination 10.0.3.12:80",
+		"THIN-LXC-POSTROUTING -s 10.0.3.0/24 -d 10.0.3.12 -p tcp --dport 80 -j MASQUERADE",
+		"THIN-LXC-POSTROUTING -s 127.0.0.0/8 -d 10.0.3.12 -p tcp --dport 80 -j MASQUERADE",
+	}
+	if strings.Join(rules, "\n") != strings.Join(expected, "\n") {
+		failTest(t, "unexpected ipv4 rules", rules)
+	}
+	//no loopback masquerade in ipv6
+	if rules := c.natRules(c.Ip6, c.Subnet6, "[fd00:10:0:3::12]:80"); len(rules) != 2 {
+		failTest(t, "unexpected ipv6 rules", rules)
+	}
+	fmt.Println("OK")
+}
+
+func Test_localnetRule(t *testing.T) {
+	fmt.Print("Testing loopback drop of the bridge ... ")
+	if rule := strings.Join(localnetRule("lxcbr0"), " "); rule != "-i lxcbr0 -d 127.0.0.0/8 -m conntrack ! --ctstate DNAT -j DROP" {
+		failTest(t, "unexpected loopback rule", rule)
+	}
+	if rule := nftLocalnetRule("lxcbr0"); rule != `add rule inet thin-lxc input iifname "lxcbr0" ip daddr 127.0.0.0/8 ct status & dnat == 0 drop` {
+		failTest(t, "unexpected nftables loopback rule", rule)
+	}
+	jumped := false
+	for _, jump := range chainJumps {
+		jumped = jumped || (jump.from == "INPUT" && jump.chain == INPUT_CHAIN)
+	}
+	if jumped == false || strings.Contains(NFT_TABLE_FILE, "hook input") == false {
+		failTest(t, "loopback drops not reached")
+	}
+	fmt.Println("OK")
+}
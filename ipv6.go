@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"strconv"
+)
+
+const IPV6_FORWARDING = "/proc/sys/net/ipv6/conf/all/forwarding"
+
+/*
+IPv6, enabled when subnet6 is set in the host config. Containers get a static address (-ip6) or
+one derived from their mac address (-ip6 auto, EUI-64, needs a /64 or shorter prefix)
+*/
+
+func (c *Container) HasIp6() bool {
+	return len(c.Ip6) > 0
+}
+
+func (c *Container) Ip6Config() string {
+	return c.Ip6 + "/" + strconv.Itoa(c.Ip6PrefixLength())
+}
+
+func (c *Container) Ip6PrefixLength() int {
+	return prefixLength(c.Subnet6)
+}
+
+//modified EUI-64 interface identifier of the mac address in the subnet prefix
+func eui64Address(subnet string, hwaddr string) (string, error) {
+	_, ipNet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return "", err
+	}
+	if ones, bits := ipNet.Mask.Size(); bits != 128 || ones > 64 {
+		return "", errors.New("auto ipv6 needs an ipv6 subnet of /64 or shorter, got " + subnet)
+	}
+	mac, err := net.ParseMAC(hwaddr)
+	if err != nil || len(mac) != 6 {
+		return "", errors.New("Invalid mac address " + hwaddr)
+	}
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, ipNet.IP.To16())
+	ip[8], ip[9], ip[10] = mac[0]^0x02, mac[1], mac[2]
+	ip[11], ip[12] = 0xff, 0xfe
+	ip[13], ip[14], ip[15] = mac[3], mac[4], mac[5]
+	return ip.String(), nil
+}
+
+func (c *Container) assignIp6(ip6 string, containers []*Container) error {
+	if len(ip6) == 0 {
+		return nil
+	}
+	if c.HasVeth() == false {
+		return errors.New("IPv6 needs eth0 to be a veth")
+	}
+	if len(c.Subnet6) == 0 {
+		return errors.New("IPv6 requested but no subnet6 in the host configuration")
+	}
+	if ip6 == "auto" {
+		var err error
+		if ip6, err = eui64Address(c.Subnet6, c.Hwaddr); err != nil {
+			return err
+		}
+	}
+	ip := net.ParseIP(ip6)
+	_, ipNet, _ := net.ParseCIDR(c.Subnet6)
+	if ip == nil || ip.To4() != nil || ipNet.Contains(ip) == false {
+		return errors.New(ip6 + " is not an ipv6 address in " + c.Subnet6)
+	}
+	for _, other := range containers {
+		if other.Name != c.Name && net.ParseIP(other.Ip6).Equal(ip) {
+			return errors.New(ip6 + " already used by " + other.Name)
+		}
+	}
+	c.Ip6 = ip.String()
+	return nil
+}
+
+//DNAT to containers only works with forwarding on, lost on reboot like iptables rules
+func enableIpv6Forwarding() error {
+	return ioutil.WriteFile(IPV6_FORWARDING, []byte("1\n"), 0644)
+}
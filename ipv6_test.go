@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func Test_assignIp6(t *testing.T) {
+	fmt.Print("Testing ipv6 address assignment ... ")
+	ip, err := eui64Address("fd00:10:0:3::/64", "00:16:3e:12:34:56")
+	if err != nil || ip != "fd00:10:0:3:216:3eff:fe12:3456" {
+		failTest(t, "wrong EUI-64 address", ip, err)
+	}
+	if _, err := eui64Address("fd00:10:0:3::/112", "00:16:3e:12:34:56"); err == nil {
+		failTest(t, "EUI-64 needs a /64")
+	}
+
+	other := &Container{Name: "db", Ip6: "fd00:10:0:3::12"}
+	c := &Container{Name: "web", Hwaddr: "00:16:3e:12:34:56", Subnet6: "fd00:10:0:3::/64"}
+	if err := c.assignIp6("fd00:10:0:3:0::12", []*Container{other}); err == nil {
+		failTest(t, "duplicate ipv6 should fail")
+	}
+	if err := c.assignIp6("fd00:99::12", nil); err == nil {
+		failTest(t, "ipv6 outside of subnet6 should fail")
+	}
+	if err := c.assignIp6("auto", []*Container{other}); err != nil || c.Ip6Config() != "fd00:10:0:3:216:3eff:fe12:3456/64" {
+		failTest(t, "auto ipv6 failed", c.Ip6Config(), err)
+	}
+
+	cfg := defaultConfig()
+	cfg.Subnet6 = "fd00:10:0:3::/64"
+	if err := cfg.validate(); err != nil || cfg.Gateway6 != "fd00:10:0:3::1" {
+		failTest(t, "default ipv6 gateway", cfg.Gateway6, err)
+	}
+	fmt.Println("OK")
+}
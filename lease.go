@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+/*
+DHCP containers. Port forwarding and firewall rules target LeaseIp, the address reserved in
+dnsmasq. The container may still get another one (dnsmasq started without the dhcp-hostsfile,
+lease of a container created before the reservation), so once it runs its actual address wins:
+rules are moved to it and the reservation follows. dnsmasq reports every lease change to its
+dhcp-script (add, old or del, hwaddr, ip, hostname), thin-lxc -a lease handles them:
+
+dhcp-script=/usr/local/bin/thin-lxc-lease
+dhcp-scriptuser=root
+
+/usr/local/bin/thin-lxc-lease:
+#!/bin/sh
+exec /usr/local/bin/thin-lxc -a lease "$@"
+*/
+
+//first ipv4 of lxc-info -i in the subnet, lxc-info lists the addresses of every interface
+func parseLxcInfoIp(out string, subnet string) string {
+	_, ipNet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return ""
+	}
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		//IP:             10.0.3.101
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || fields[0] != "IP:" {
+			continue
+		}
+		if ip := net.ParseIP(fields[1]); ip != nil && ip.To4() != nil && ipNet.Contains(ip) {
+			return ip.String()
+		}
+	}
+	return ""
+}
+
+func (c *Container) runningIp() string {
+	stdout, err := exec.Command("lxc-info", "-n", c.Name, "-i").Output()
+	if err != nil {
+		return ""
+	}
+	return parseLxcInfoIp(string(stdout), c.Subnet)
+}
+
+//actual address of a DHCP container: lxc-info if it runs, its dnsmasq lease otherwise, empty if unknown
+func (c *Container) resolveAddress() string {
+	if c.HasStaticIp() {
+		return c.Ip
+	}
+	if c.isRunning() {
+		if ip := c.runningIp(); len(ip) > 0 {
+			return ip
+		}
+	}
+	return readLeases(config.DnsmasqLeases)[strings.ToLower(c.Hwaddr)]
+}
+
+//removes the rules of the old address and saves the new one, the caller adds the rules back
+func (c *Container) moveLease(ip string) (bool, error) {
+	if c.HasStaticIp() || c.HasVeth() == false || len(ip) == 0 || ip == c.LeaseIp {
+		return false, nil
+	}
+	if err := c.unforwardPort(); err != nil {
+		return false, err
+	}
+	if err := c.removeFirewall(); err != nil {
+		return false, err
+	}
+	c.LeaseIp = ip
+	return true, c.marshall()
+}
+
+func (c *Container) syncLease(ip string) error {
+	moved, err := c.moveLease(ip)
+	if err != nil || moved == false {
+		return err
+	}
+	if err := c.applyFirewall(); err != nil {
+		return err
+	}
+	return c.forwardPort()
+}
+
+//container with the hwaddr on eth0, nil if none
+func findByHwaddr(containers []*Container, hwaddr string) *Container {
+	for _, c := range containers {
+		if strings.EqualFold(c.Hwaddr, hwaddr) {
+			return c
+		}
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func Test_leaseSync(t *testing.T) {
+	fmt.Print("Testing DHCP addresses ... ")
+	out := "Name:           web\nState:          RUNNING\nIP:             10.0.3.101\nIP:             192.168.50.10\nIP:             fd00:10:0:3::65\n"
+	if ip := parseLxcInfoIp(out, DEFAULT_SUBNET); ip != "10.0.3.101" {
+		failTest(t, "address on the bridge subnet expected", ip)
+	}
+	if ip := parseLxcInfoIp(out, "172.16.0.0/16"); ip != "" {
+		failTest(t, "no address expected outside of the subnet", ip)
+	}
+
+	c := &Container{Name: "web", Subnet: DEFAULT_SUBNET, Hwaddr: "00:16:3E:00:00:01", LeaseIp: "10.0.3.100", Port: 80, HostPort: 8080}
+	if findByHwaddr([]*Container{c}, "00:16:3e:00:00:01") != c {
+		failTest(t, "hwaddr lookup should ignore case")
+	}
+	for _, statement := range c.nftPortElements("add") {
+		if strings.Contains(statement, "10.0.3.100 . 80") == false {
+			failTest(t, "port should be forwarded to the lease", statement)
+		}
+	}
+	if moved, err := c.moveLease("10.0.3.100"); moved || err != nil {
+		failTest(t, "same lease shouldn't move the rules", moved, err)
+	}
+	if moved, err := c.moveLease(""); moved || err != nil {
+		failTest(t, "unknown address shouldn't move the rules", moved, err)
+	}
+	static := &Container{Name: "db", Ip: "10.0.3.12", Subnet: DEFAULT_SUBNET}
+	if moved, _ := static.moveLease("10.0.3.101"); moved {
+		failTest(t, "static address shouldn't move")
+	}
+	fmt.Println("OK")
+}
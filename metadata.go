@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+/*
+Metadata schema (.metadata.json). Every change to the Container fields that would break loading
+existing metadata (rename, new field without a usable zero value ...) bumps METADATA_VERSION and
+adds a migration to metadataMigrations. Migrations run on load, the file is upgraded in place and
+the original kept as .metadata.json.v<version>.bak
+*/
+
+const METADATA_VERSION = 3
+
+type metadata map[string]interface{}
+
+//metadataMigrations[i] upgrades version i to i + 1
+var metadataMigrations = []func(m metadata, metadataPath string) error{
+	migrateMetadataV0,
+	migrateMetadataV1,
+	migrateMetadataV2,
+}
+
+func (m metadata) version() int {
+	v, _ := m["SchemaVersion"].(float64)
+	return int(v)
+}
+
+func (m metadata) str(key string) string {
+	s, _ := m[key].(string)
+	return s
+}
+
+func (m metadata) setDefault(key string, value interface{}) {
+	if v, ok := m[key]; ok == false || v == nil || v == "" {
+		m[key] = value
+	}
+}
+
+/*
+v0: no version field. Written by thin-lxc <= 0.4, either in the README id based layout
+(<root>/<id>/<name>, with an Id field) or in <root>/<name>, before or after the host config file
+*/
+func migrateMetadataV0(m metadata, metadataPath string) error {
+	if len(m.str("Name")) == 0 {
+		return errors.New("no container name")
+	}
+	m.setDefault("Path", path.Dir(metadataPath))
+	m.setDefault("RootPath", path.Dir(m.str("Path")))
+	m.setDefault("RoLayer", m.str("Path")+"/"+m.str("Name"))
+	m.setDefault("WrLayer", m.str("Path")+"/.wlayer")
+	m.setDefault("Rootfs", m.str("RoLayer")+"/rootfs")
+	m.setDefault("ConfigPath", m.str("RoLayer")+"/config")
+	delete(m, "Id")
+
+	m.setDefault("HostName", m.str("Name"))
+	if len(m.str("Ip")) > 0 {
+		m.setDefault("Inet", "manual")
+	} else {
+		m.setDefault("Inet", "dhcp")
+	}
+
+	m.setDefault("StorageDriver", DEFAULT_STORAGE_DRIVER)
+	m.setDefault("Bridge", DEFAULT_BRIDGE)
+	m.setDefault("Subnet", DEFAULT_SUBNET)
+	m.setDefault("Gateway", DEFAULT_GATEWAY)
+
+	//provenance unknown, metadata file time is the best guess for creation time
+	if info, err := os.Stat(metadataPath); err == nil {
+		m.setDefault("CreatedAt", info.ModTime().UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+//v1: no guest detection, every container got the upstart gateway job and /etc/network/interfaces
+func migrateMetadataV1(m metadata, metadataPath string) error {
+	m.setDefault("Init", INIT_UPSTART)
+	m.setDefault("NetworkConfig", NET_IFUPDOWN)
+	return nil
+}
+
+//v2: a single veth on Bridge, no NetworkType
+func migrateMetadataV2(m metadata, metadataPath string) error {
+	m.setDefault("NetworkType", NET_TYPE_VETH)
+	return nil
+}
+
+func unmarshallFile(metadataPath string) (*Container, error) {
+	b, err := ioutil.ReadFile(metadataPath)
+	if err != nil {
+		return nil, err
+	}
+	var m metadata
+	if err = json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+
+	version := m.version()
+	if version > METADATA_VERSION {
+		return nil, fmt.Errorf("%s: schema version %d is newer than this thin-lxc (%d)", metadataPath, version, METADATA_VERSION)
+	}
+	if version < METADATA_VERSION {
+		for v := version; v < METADATA_VERSION; v++ {
+			if err := metadataMigrations[v](m, metadataPath); err != nil {
+				return nil, fmt.Errorf("%s: migration from schema version %d failed: %v", metadataPath, v, err)
+			}
+			m["SchemaVersion"] = v + 1
+		}
+		if b, err = upgradeMetadataFile(metadataPath, b, version, m); err != nil {
+			return nil, err
+		}
+	}
+
+	var c Container
+	if err = json.Unmarshal(b, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func upgradeMetadataFile(metadataPath string, original []byte, version int, m metadata) ([]byte, error) {
+	backup := fmt.Sprintf("%s.v%d.bak", metadataPath, version)
+	if err := ioutil.WriteFile(backup, original, 0644); err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	tmp := metadataPath + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return nil, err
+	}
+	return b, os.Rename(tmp, metadataPath)
+}
+
+//root/name, or root/<id> for containers created with the id based layout
+func findMetadata(root string, name string) (string, error) {
+	metadataPath := root + "/" + name + "/.metadata.json"
+	if fileExists(metadataPath) {
+		return metadataPath, nil
+	}
+	dirs, err := ioutil.ReadDir(root)
+	if err != nil {
+		return "", err
+	}
+	for i := range dirs {
+		candidate := root + "/" + dirs[i].Name() + "/.metadata.json"
+		b, err := ioutil.ReadFile(candidate)
+		if err != nil {
+			continue
+		}
+		var m metadata
+		if json.Unmarshal(b, &m) == nil && m.str("Name") == name {
+			return candidate, nil
+		}
+	}
+	return "", errors.New("No container named " + name + " in " + root)
+}
+
+//every container in root, metadata that can't be loaded is logged and skipped
+func listContainers(root string) ([]*Container, error) {
+	containers := []*Container{}
+	dirs, err := ioutil.ReadDir(root)
+	if os.IsNotExist(err) {
+		return containers, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i := range dirs {
+		metadataPath := root + "/" + dirs[i].Name() + "/.metadata.json"
+		if fileExists(metadataPath) == false {
+			continue
+		}
+		c, err := unmarshallFile(metadataPath)
+		if err != nil {
+			log.Println("Unable to unmarshall", dirs[i].Name(), err)
+			continue
+		}
+		containers = append(containers, c)
+	}
+	return containers, nil
+}
+
+/*
+Roots searched for containers: the configured one first, then every root containers were created
+in (ROOTS_FILE, at a fixed place), so changing root_path or -r keeps the existing containers where
+their metadata says they are. Containers of the old layout stay in LEGACY_ROOT_PATH until migrated
+(-a migrate), they still work from there.
+*/
+const ROOTS_FILE = CONTAINERS_ROOT_PATH + "/.roots"
+
+//variables so tests don't use the host ones
+var legacyRootPath = LEGACY_ROOT_PATH
+var rootsFile = ROOTS_FILE
+
+//one per line
+func recordedRoots() []string {
+	b, err := ioutil.ReadFile(rootsFile)
+	if err != nil {
+		return nil
+	}
+	roots := []string{}
+	for _, line := range strings.Split(string(b), "\n") {
+		if line = strings.TrimSpace(line); len(line) > 0 {
+			roots = append(roots, line)
+		}
+	}
+	return roots
+}
+
+func recordRoot(root string) error {
+	root = path.Clean(root)
+	for _, recorded := range recordedRoots() {
+		if path.Clean(recorded) == root {
+			return nil
+		}
+	}
+	if err := os.MkdirAll(path.Dir(rootsFile), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(rootsFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(root + "\n")
+	return err
+}
+
+func containerRoots() []string {
+	roots := []string{}
+	seen := make(map[string]bool)
+	for _, root := range append(append([]string{config.RootPath}, recordedRoots()...), legacyRootPath) {
+		if seen[path.Clean(root)] || (root == legacyRootPath && fileExists(root) == false) {
+			continue
+		}
+		seen[path.Clean(root)] = true
+		roots = append(roots, root)
+	}
+	return roots
+}
+
+//every container of every root, a name found twice is only taken from the first root
+func listAllContainers() ([]*Container, error) {
+	all := []*Container{}
+	names := make(map[string]string)
+	for _, root := range containerRoots() {
+		containers, err := listContainers(root)
+		if err != nil {
+			return nil, err
+		}
+		//containers created before roots were recorded, best effort as listing doesn't need to write
+		if len(containers) > 0 && root == config.RootPath {
+			recordRoot(root)
+		}
+		for _, c := range containers {
+			if other, ok := names[c.Name]; ok {
+				log.Println("Container", c.Name, "of", root, "ignored, already in", other)
+				continue
+			}
+			names[c.Name] = root
+			all = append(all, c)
+		}
+	}
+	return all, nil
+}
+
+//metadata of the container in the first root having it
+func findContainerMetadata(name string) (string, error) {
+	roots := containerRoots()
+	for _, root := range roots {
+		if metadataPath, err := findMetadata(root, name); err == nil {
+			return metadataPath, nil
+		}
+	}
+	return "", errors.New("No container named " + name + " in " + strings.Join(roots, ", "))
+}
+
+//logged by list and reload, until they are migrated
+func warnLegacyContainers(containers []*Container) {
+	for _, c := range containers {
+		if path.Clean(c.RootPath) == path.Clean(legacyRootPath) && path.Clean(c.RootPath) != path.Clean(config.RootPath) {
+			log.Println("Container", c.Name, "is still in", legacyRootPath + ", run thin-lxc -a migrate to move it to", config.RootPath)
+		}
+	}
+}
+
+/*
+Base digest, recorded next to the base container by pull (<base>.digest) so every container
+created from it knows which image it comes from. Empty for custom bases.
+*/
+
+func baseDigestPath(base string) string {
+	return path.Clean(base) + ".digest"
+}
+
+func baseDigest(base string) string {
+	b, err := ioutil.ReadFile(baseDigestPath(base))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
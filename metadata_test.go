@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func Test_metadataMigrations(t *testing.T) {
+	fmt.Print("Testing metadata schema migrations ... ")
+	root, _ := ioutil.TempDir("", "thin-lxc-metadata")
+	defer os.RemoveAll(root)
+
+	//README id based layout, unversioned
+	os.MkdirAll(root+"/4f2a", 0700)
+	legacy := `{"Id":"4f2a","BaseContainerPath":"/var/lib/lxc/baseCN","Path":"` + root + `/4f2a","RoLayer":"` + root + `/4f2a/web","WrLayer":"` + root + `/4f2a/.wlayer","Rootfs":"` + root + `/4f2a/web/rootfs","ConfigPath":"` + root + `/4f2a/web/config","Ip":"10.0.3.12","Hwaddr":"00:16:3e:01:02:03","Name":"web","Port":80,"HostPort":8080}`
+	ioutil.WriteFile(root+"/4f2a/.metadata.json", []byte(legacy), 0644)
+
+	metadataPath, err := findMetadata(root, "web")
+	if err != nil || metadataPath != root+"/4f2a/.metadata.json" {
+		failTest(t, "id based container not found", metadataPath, err)
+	}
+	c, err := unmarshallFile(metadataPath)
+	if err != nil {
+		failTest(t, "unable to load unversioned metadata", err)
+	}
+	if c.SchemaVersion != METADATA_VERSION || c.HostName != "web" || c.Inet != "manual" || c.Bridge != DEFAULT_BRIDGE || c.RootPath != root || c.Init != INIT_UPSTART {
+		failTest(t, "metadata not migrated", c)
+	}
+	if c.CreatedAt.IsZero() {
+		failTest(t, "creation time not set")
+	}
+	if b, _ := ioutil.ReadFile(metadataPath + ".v0.bak"); string(b) != legacy {
+		failTest(t, "original metadata not backed up")
+	}
+	var m metadata
+	b, _ := ioutil.ReadFile(metadataPath)
+	json.Unmarshal(b, &m)
+	if m.version() != METADATA_VERSION || m["Id"] != nil {
+		failTest(t, "metadata file not upgraded in place", string(b))
+	}
+
+	//metadata from the future must not be silently loaded
+	ioutil.WriteFile(metadataPath, []byte(`{"SchemaVersion":999,"Name":"web"}`), 0644)
+	if _, err := unmarshallFile(metadataPath); err == nil {
+		failTest(t, "newer schema version should fail")
+	}
+	fmt.Println("OK")
+}
+
+func Test_containerRoots(t *testing.T) {
+	fmt.Print("Testing containers of every root ... ")
+	root, _ := ioutil.TempDir("", "thin-lxc-root")
+	defer os.RemoveAll(root)
+	legacy, _ := ioutil.TempDir("", "thin-lxc-legacy")
+	defer os.RemoveAll(legacy)
+	rootPath := config.RootPath
+	config.RootPath, legacyRootPath, rootsFile = root, legacy, root + "/.roots"
+	defer func() { config.RootPath, legacyRootPath, rootsFile = rootPath, LEGACY_ROOT_PATH, ROOTS_FILE }()
+
+	for _, c := range []*Container{{Name: "web", RootPath: root}, {Name: "db", RootPath: legacy}, {Name: "web", RootPath: legacy}} {
+		c.Path = c.RootPath + "/" + c.Name
+		c.SchemaVersion = METADATA_VERSION
+		os.MkdirAll(c.Path, 0700)
+		b, _ := json.Marshal(c)
+		ioutil.WriteFile(c.Path + "/.metadata.json", b, 0644)
+	}
+	containers, err := listAllContainers()
+	if err != nil || len(containers) != 2 || containers[0].Name != "web" || containers[0].RootPath != root || containers[1].Name != "db" {
+		failTest(t, "containers of the legacy root should be listed once", containers, err)
+	}
+	if c, err := unmarshall("db"); err != nil || c.RootPath != legacy {
+		failTest(t, "container of the legacy root not found", err)
+	}
+	if c, err := unmarshall("web"); err != nil || c.RootPath != root {
+		failTest(t, "configured root should come first", err)
+	}
+	if _, err := unmarshall("api"); err == nil {
+		failTest(t, "unknown container should fail")
+	}
+
+	//root_path changed, containers of the previous root are still found
+	config.RootPath = root + "/new"
+	if c, err := unmarshall("web"); err != nil || c.RootPath != root {
+		failTest(t, "container of the previous root not found", err)
+	}
+	if containers, err := listAllContainers(); err != nil || len(containers) != 2 {
+		failTest(t, "containers of the previous root should be listed", containers, err)
+	}
+	if _, err := newContainer("", "web", "", "", "", ""); err == nil {
+		failTest(t, "name of a container of the previous root should be taken")
+	}
+	if roots := recordedRoots(); len(roots) != 1 || roots[0] != root {
+		failTest(t, "root recorded once", roots)
+	}
+	fmt.Println("OK")
+}
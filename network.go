@@ -0,0 +1,304 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+//LXC network types
+const (
+	NET_TYPE_VETH = "veth"       //pair with one end on a host bridge, the default
+	NET_TYPE_MACVLAN = "macvlan" //on a physical interface, unreachable from the host itself
+	NET_TYPE_NONE = "none"       //loopback only, eth0 only
+)
+
+//linux IFNAMSIZ - 1
+const MAX_IFNAME_LENGTH = 15
+
+/*
+Network interfaces. eth0 is described by the Container fields (Bridge is its link), it is the
+one with the default route, dns and port forwarding. Extra interfaces (eth1, eth2 ...) come from
+-net specs:
+
+-net type=veth,link=br-storage,ip=192.168.50.10/24
+-net name=eth0,type=macvlan,link=enp3s0,ip=192.168.1.50/24,gw=192.168.1.1
+
+keys: name, type, link, ip, gw (eth0 only), hw, veth (host side name of the veth pair)
+*/
+
+type Interface struct {
+	Name string
+	Type string
+	Link string
+	Hwaddr string
+	Ip string
+	Subnet string
+	VethPair string
+}
+
+func (i *Interface) HasStaticIp() bool {
+	return len(i.Ip) > 0
+}
+
+func (i *Interface) IpConfig() string {
+	return i.Ip + "/" + strconv.Itoa(i.PrefixLength())
+}
+
+func (i *Interface) PrefixLength() int {
+	return prefixLength(i.Subnet)
+}
+
+func (i *Interface) Netmask() string {
+	return netmask(i.Subnet)
+}
+
+func (i *Interface) Inet() string {
+	if i.HasStaticIp() {
+		return "manual"
+	}
+	return "dhcp"
+}
+
+func (c *Container) HasNetwork() bool {
+	return c.NetworkType != NET_TYPE_NONE
+}
+
+//eth0 is a veth, routed through the host: port forwarding, dnsmasq leases, ipv6
+func (c *Container) HasVeth() bool {
+	return c.NetworkType != NET_TYPE_MACVLAN && c.NetworkType != NET_TYPE_NONE
+}
+
+//route added by the ifupdown gateway job, off the bridge a DHCP lease brings its own
+func (c *Container) SetsGateway() bool {
+	return c.HasNetwork() && (c.HasStaticIp() || c.HasVeth())
+}
+
+//repeatable string flag
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+var netKeys = map[string]bool{"name": true, "type": true, "link": true, "ip": true, "gw": true, "hw": true, "veth": true}
+
+func parseNetArg(spec string) (map[string]string, error) {
+	kv := make(map[string]string)
+	for _, pair := range splitList(spec) {
+		arr := strings.SplitN(pair, "=", 2)
+		if len(arr) != 2 || netKeys[arr[0]] == false {
+			return nil, errors.New("Invalid network spec " + pair + ", expected name|type|link|ip|gw|hw|veth=value")
+		}
+		kv[arr[0]] = arr[1]
+	}
+	return kv, nil
+}
+
+//"192.168.1.50/24" -> ip and subnet, "10.0.3.50" -> ip and the default subnet
+func parseIpArg(ip string, subnet string) (string, string, error) {
+	if strings.Contains(ip, "/") {
+		addr, ipNet, err := net.ParseCIDR(ip)
+		if err != nil || addr.To4() == nil {
+			return "", "", errors.New("Invalid ipv4 address " + ip)
+		}
+		return addr.String(), ipNet.String(), nil
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil || addr.To4() == nil {
+		return "", "", errors.New("Invalid ipv4 address " + ip)
+	}
+	if _, ipNet, err := net.ParseCIDR(subnet); err != nil || ipNet.Contains(addr) == false {
+		return "", "", errors.New(ip + " is not in " + subnet + ", give it with its prefix length e.g: " + ip + "/24")
+	}
+	return addr.String(), subnet, nil
+}
+
+//-net specs, in order, eth1, eth2 ... unless named
+func (c *Container) setNetworks(specs []string, containers []*Container) error {
+	for _, spec := range specs {
+		kv, err := parseNetArg(spec)
+		if err != nil {
+			return err
+		}
+		name := kv["name"]
+		if len(name) == 0 {
+			name = "eth" + strconv.Itoa(len(c.Interfaces) + 1)
+		}
+		if name == "eth0" {
+			err = c.setPrimaryNetwork(kv, containers)
+		} else {
+			err = c.addInterface(name, kv, containers)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return c.validateNetwork(containers)
+}
+
+func (c *Container) setPrimaryNetwork(kv map[string]string, containers []*Container) error {
+	if t, ok := kv["type"]; ok {
+		c.NetworkType = t
+	}
+	if link, ok := kv["link"]; ok {
+		c.Bridge = link
+	}
+	switch c.NetworkType {
+	case NET_TYPE_NONE:
+		c.Ip, c.Inet, c.Hwaddr, c.Nameservers = "", "manual", "", nil
+		return nil
+	case NET_TYPE_MACVLAN:
+		if _, ok := kv["link"]; ok == false {
+			return errors.New("macvlan needs the host interface as link")
+		}
+	case NET_TYPE_VETH:
+	default:
+		return errors.New("Unknown network type " + c.NetworkType + " for eth0, expected veth, macvlan or none")
+	}
+	if ip, ok := kv["ip"]; ok {
+		var err error
+		if c.Ip, c.Subnet, err = parseIpArg(ip, config.Subnet); err != nil {
+			return err
+		}
+		c.Inet = "manual"
+	}
+	if gw, ok := kv["gw"]; ok {
+		if net.ParseIP(gw) == nil {
+			return errors.New("Invalid gateway " + gw)
+		}
+		c.Gateway = gw
+	}
+	if c.HasStaticIp() && c.Subnet != config.Subnet && c.Gateway == config.Gateway {
+		return errors.New("eth0 is outside " + config.Subnet + ", give its gateway with gw=")
+	}
+	//the bridge dnsmasq is unreachable, use the gateway (static ip) or the DHCP server (lease)
+	if c.HasVeth() == false && len(config.Nameservers) == 0 {
+		c.Nameservers = nil
+		if c.HasStaticIp() {
+			c.Nameservers = []string{c.Gateway}
+		}
+	}
+	if hw, ok := kv["hw"]; ok {
+		if err := c.setHwaddr(hw, containers); err != nil {
+			return err
+		}
+	}
+	c.VethPair = kv["veth"]
+	return nil
+}
+
+func (c *Container) addInterface(name string, kv map[string]string, containers []*Container) error {
+	i := &Interface{Name: name, Type: NET_TYPE_VETH, Link: kv["link"], VethPair: kv["veth"]}
+	if t, ok := kv["type"]; ok {
+		i.Type = t
+	}
+	if i.Type != NET_TYPE_VETH && i.Type != NET_TYPE_MACVLAN {
+		return errors.New("Unknown network type " + i.Type + " for " + name + ", expected veth or macvlan")
+	}
+	if len(i.Link) == 0 {
+		return errors.New(name + " needs a link (host bridge or interface)")
+	}
+	if _, ok := kv["gw"]; ok {
+		return errors.New("gw is only supported on eth0, it has the default route")
+	}
+	if ip, ok := kv["ip"]; ok {
+		var err error
+		if i.Ip, i.Subnet, err = parseIpArg(ip, config.Subnet); err != nil {
+			return err
+		}
+	}
+	if hw, ok := kv["hw"]; ok {
+		mac, err := net.ParseMAC(hw)
+		if err != nil || len(mac) != 6 || mac[0]&1 != 0 {
+			return errors.New("Invalid mac address " + hw)
+		}
+		if other := hwaddrTaken(mac.String(), c.Name, containers); len(other) > 0 {
+			return errors.New(hw + " already used by " + other)
+		}
+		if hwaddrTaken(mac.String(), "", []*Container{c}) != "" {
+			return errors.New(hw + " already used by another interface of " + c.Name)
+		}
+		i.Hwaddr = mac.String()
+	} else {
+		//the container itself is checked too, eth0 and the interfaces added before
+		i.Hwaddr = stableHwaddr(c.Name + "/" + name, hostId(), append(containers, c))
+	}
+	c.Interfaces = append(c.Interfaces, i)
+	return nil
+}
+
+//names, veth pair names and addresses are unique
+func (c *Container) validateNetwork(containers []*Container) error {
+	names := map[string]bool{"eth0": true}
+	pairs := make(map[string]string)
+	ips := make(map[string]string)
+	for _, other := range containers {
+		if other.Name == c.Name {
+			continue
+		}
+		if len(other.VethPair) > 0 {
+			pairs[other.VethPair] = other.Name
+		}
+		for _, i := range other.Interfaces {
+			if len(i.VethPair) > 0 {
+				pairs[i.VethPair] = other.Name
+			}
+			if i.HasStaticIp() {
+				ips[i.Link + "/" + i.Ip] = other.Name
+			}
+		}
+	}
+	if len(c.VethPair) > 0 {
+		if len(c.VethPair) > MAX_IFNAME_LENGTH {
+			return fmt.Errorf("veth pair name %s is longer than %d characters", c.VethPair, MAX_IFNAME_LENGTH)
+		}
+		if other, ok := pairs[c.VethPair]; ok {
+			return errors.New("veth pair name " + c.VethPair + " already used by " + other)
+		}
+		pairs[c.VethPair] = c.Name
+	}
+	for _, i := range c.Interfaces {
+		if names[i.Name] {
+			return errors.New("Interface " + i.Name + " defined twice")
+		}
+		names[i.Name] = true
+		if len(i.VethPair) > 0 {
+			if i.Type != NET_TYPE_VETH {
+				return errors.New("veth pair name given for " + i.Type + " interface " + i.Name)
+			}
+			if len(i.VethPair) > MAX_IFNAME_LENGTH {
+				return fmt.Errorf("veth pair name %s is longer than %d characters", i.VethPair, MAX_IFNAME_LENGTH)
+			}
+			if other, ok := pairs[i.VethPair]; ok {
+				return errors.New("veth pair name " + i.VethPair + " already used by " + other)
+			}
+			pairs[i.VethPair] = c.Name
+		}
+		if i.HasStaticIp() {
+			if other, ok := ips[i.Link + "/" + i.Ip]; ok {
+				return errors.New(i.Ip + " already used on " + i.Link + " by " + other)
+			}
+			ips[i.Link + "/" + i.Ip] = c.Name
+		}
+	}
+	if len(c.VethPair) > 0 && c.NetworkType != NET_TYPE_VETH {
+		return errors.New("veth pair name given for " + c.NetworkType + " eth0")
+	}
+	if c.HostPort > 0 && c.HasVeth() == false {
+		return errors.New("Port forwarding needs eth0 to be a veth")
+	}
+	return nil
+}
+
+//guest template for an extra interface, the Interface is the data, the Container is $
+func interfaceTemplate(index int, content string) string {
+	return fmt.Sprintf("{{with index .Interfaces %d}}%s{{end}}", index, content)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func Test_setNetworks(t *testing.T) {
+	fmt.Print("Testing network interfaces ... ")
+	newWeb := func() *Container {
+		return &Container{Name: "web", HostName: "web", NetworkType: NET_TYPE_VETH, Bridge: DEFAULT_BRIDGE, Subnet: DEFAULT_SUBNET, Gateway: DEFAULT_GATEWAY, Hwaddr: "00:16:3e:00:00:01", Nameservers: []string{DEFAULT_GATEWAY}}
+	}
+	other := &Container{Name: "db", VethPair: "vethdb", Interfaces: []*Interface{{Name: "eth1", Link: "br-storage", Ip: "192.168.50.10", Hwaddr: "00:16:3e:00:00:0a"}}}
+
+	c := newWeb()
+	specs := []string{"link=br-storage,ip=192.168.50.11/24,veth=vethweb1", "type=macvlan,link=enp3s0"}
+	if err := c.setNetworks(specs, []*Container{other}); err != nil {
+		failTest(t, "setNetworks failed", err)
+	}
+	if len(c.Interfaces) != 2 || c.Interfaces[0].Name != "eth1" || c.Interfaces[1].Name != "eth2" || c.Interfaces[0].IpConfig() != "192.168.50.11/24" || c.Interfaces[1].Inet() != "dhcp" {
+		failTest(t, "interfaces not set", c.Interfaces)
+	}
+	if c.Interfaces[0].Hwaddr == c.Hwaddr || strings.HasPrefix(c.Interfaces[0].Hwaddr, HWADDR_PREFIX) == false {
+		failTest(t, "extra interface should get its own mac address", c.Interfaces[0].Hwaddr)
+	}
+	//eth0 has the address eth1 would hash to
+	c = newWeb()
+	c.Hwaddr = stableHwaddr("web/eth1", hostId(), nil)
+	if err := c.setNetworks([]string{"link=br-storage"}, nil); err != nil || c.Interfaces[0].Hwaddr == c.Hwaddr {
+		failTest(t, "extra interface should not reuse the mac address of eth0", c.Interfaces, err)
+	}
+	c = newWeb()
+	if err := c.setNetworks([]string{"link=br-storage,hw=00:16:3e:00:00:01"}, nil); err == nil {
+		failTest(t, "mac address of eth0 should be refused")
+	}
+
+	invalid := [][]string{
+		{"link=br-storage,ip=192.168.50.10/24"},     //address used by db
+		{"link=br-storage,veth=vethdb"},             //pair name used by db
+		{"link=br-storage,veth=veth-way-too-long"},  //longer than IFNAMSIZ
+		{"ip=192.168.50.12/24"},                     //no link
+		{"link=br-storage,gw=192.168.50.1"},         //gw on eth1
+		{"name=eth0,type=macvlan"},                  //no link
+		{"name=eth0,type=vxlan"},
+		{"name=eth0,type=macvlan,link=enp3s0,ip=192.168.1.50/24"}, //no gateway
+		{"link=br-storage,mtu=9000"},
+	}
+	for _, specs := range invalid {
+		if err := newWeb().setNetworks(specs, []*Container{other}); err == nil {
+			failTest(t, "network spec should fail", specs)
+		}
+	}
+
+	//macvlan eth0 leaves the bridge, its dns and port forwarding
+	c = newWeb()
+	if err := c.setNetworks([]string{"name=eth0,type=macvlan,link=enp3s0,ip=192.168.1.50/24,gw=192.168.1.1"}, nil); err != nil {
+		failTest(t, "macvlan eth0 failed", err)
+	}
+	if c.IpConfig() != "192.168.1.50/24" || c.Gateway != "192.168.1.1" || c.Nameservers[0] != "192.168.1.1" || c.HasVeth() {
+		failTest(t, "macvlan eth0 not set", c.IpConfig(), c.Gateway, c.Nameservers)
+	}
+	c = newWeb()
+	c.HostPort, c.Port = 8080, 80
+	if err := c.setNetworks([]string{"name=eth0,type=macvlan,link=enp3s0"}, nil); err == nil {
+		failTest(t, "port forwarding to macvlan should fail")
+	}
+	fmt.Println("OK")
+}
+
+func Test_networkTemplates(t *testing.T) {
+	fmt.Print("Testing network interfaces configuration ... ")
+	dir, _ := ioutil.TempDir("", "thin-lxc-network")
+	defer os.RemoveAll(dir)
+
+	c := &Container{
+		Name: "web",
+		HostName: "web",
+		NetworkType: NET_TYPE_NONE,
+		Rootfs: dir + "/rootfs",
+		NetworkConfig: NET_NETWORKD,
+		Interfaces: []*Interface{
+			{Name: "eth1", Type: NET_TYPE_VETH, Link: "br-storage", Ip: "192.168.50.11", Subnet: "192.168.50.0/24", Hwaddr: "00:16:3e:00:00:02", VethPair: "vethweb1"},
+			{Name: "eth2", Type: NET_TYPE_MACVLAN, Link: "enp3s0", Hwaddr: "00:16:3e:00:00:03"},
+		},
+	}
+	if err := c.executeTemplate(CONFIG_FILE, dir + "/config"); err != nil {
+		failTest(t, "unable to render config", err)
+	}
+	b, _ := ioutil.ReadFile(dir + "/config")
+	for _, line := range []string{"lxc.network.type = empty", "lxc.network.link = br-storage", "lxc.network.veth.pair = vethweb1", "lxc.network.ipv4 = 192.168.50.11/24", "lxc.network.name = eth2", "lxc.network.macvlan.mode = bridge"} {
+		if strings.Contains(string(b), line) == false {
+			failTest(t, "config missing", line, string(b))
+		}
+	}
+
+	files := c.guestFiles()
+	if _, ok := files["/etc/systemd/network/eth0.network"]; ok {
+		failTest(t, "no eth0 configuration expected without network")
+	}
+	for path, template := range files {
+		if err := c.executeTemplate(template, c.Rootfs + path); err != nil {
+			failTest(t, "unable to render", path, err)
+		}
+	}
+	b, _ = ioutil.ReadFile(c.Rootfs + "/etc/systemd/network/eth1.network")
+	if strings.Contains(string(b), "Name=eth1") == false || strings.Contains(string(b), "Address=192.168.50.11/24") == false {
+		failTest(t, "eth1 not configured", string(b))
+	}
+	b, _ = ioutil.ReadFile(c.Rootfs + "/etc/systemd/network/eth2.network")
+	if strings.Contains(string(b), "DHCP=ipv4") == false || strings.Contains(string(b), "UseRoutes=false") == false {
+		failTest(t, "eth2 not configured", string(b))
+	}
+	fmt.Println("OK")
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const NFT_TABLE = "inet thin-lxc"
+
+/*
+nftables backend, everything in the thin-lxc table. Published ports are elements of maps
+(host port -> container address . port) used by fixed DNAT rules, so forwarding a port never adds
+a rule. Hairpin as with iptables: connections to a published container port coming from one of
+the container subnets or from the host over loopback are masqueraded, the input chain drops what
+containers send to loopback addresses without DNAT (see enableRouteLocalnet). Policies are a chain per
+container (container-<name>), jumped to from the forward chain by rules tagged with the container
+name, ip and ip6.
+*/
+const NFT_TABLE_FILE = `
+table inet thin-lxc {
+	map ports4 { type inet_service : ipv4_addr . inet_service; }
+	map ports6 { type inet_service : ipv6_addr . inet_service; }
+	set published4 { type ipv4_addr . inet_service; }
+	set published6 { type ipv6_addr . inet_service; }
+	set subnets4 { type ipv4_addr; flags interval; }
+	set subnets6 { type ipv6_addr; flags interval; }
+
+	chain prerouting {
+		type nat hook prerouting priority -100; policy accept;
+		meta nfproto ipv4 fib daddr type local dnat ip to tcp dport map @ports4
+		meta nfproto ipv6 fib daddr type local dnat ip6 to tcp dport map @ports6
+	}
+	chain output {
+		type nat hook output priority -100; policy accept;
+		meta nfproto ipv4 fib daddr type local dnat ip to tcp dport map @ports4
+		meta nfproto ipv6 fib daddr type local dnat ip6 to tcp dport map @ports6
+	}
+	chain postrouting {
+		type nat hook postrouting priority 100; policy accept;
+		ct status dnat ip daddr . tcp dport @published4 ip saddr @subnets4 masquerade
+		ct status dnat ip daddr . tcp dport @published4 ip saddr 127.0.0.0/8 masquerade
+		ct status dnat ip6 daddr . tcp dport @published6 ip6 saddr @subnets6 masquerade
+	}
+	chain forward {
+		type filter hook forward priority 0; policy accept;
+	}
+	chain input {
+		type filter hook input priority 0; policy accept;
+	}
+}
+`
+
+type nftablesBackend struct{}
+
+func nftDo(statement string) error {
+	return runCmdWithDetailedError(exec.Command("nft", statement))
+}
+
+//statements applied at once, or not at all
+func nftScript(script string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	return runCmdWithDetailedError(cmd)
+}
+
+//the table is created once, with its chains and fixed rules
+func ensureNftTable() error {
+	if nftDo("list table " + NFT_TABLE) == nil {
+		return nil
+	}
+	return nftScript(NFT_TABLE_FILE)
+}
+
+//statements adding (add) or removing (delete) the published port elements
+func (c *Container) nftPortElements(action string) []string {
+	hostPort, port := strconv.Itoa(c.HostPort), strconv.Itoa(c.Port)
+	statements := []string{
+		action + " element " + NFT_TABLE + " ports4 { " + hostPort + " : " + c.Address() + " . " + port + " }",
+		action + " element " + NFT_TABLE + " published4 { " + c.Address() + " . " + port + " }",
+	}
+	if c.HasIp6() {
+		statements = append(statements,
+			action + " element " + NFT_TABLE + " ports6 { " + hostPort + " : " + c.Ip6 + " . " + port + " }",
+			action + " element " + NFT_TABLE + " published6 { " + c.Ip6 + " . " + port + " }")
+	}
+	return statements
+}
+
+//tables created before the input chain get it here, add chain does nothing if it exists
+func ensureNftLocalnetRule(bridge string) error {
+	if err := nftDo("add chain " + NFT_TABLE + " input { type filter hook input priority 0; policy accept; }"); err != nil {
+		return err
+	}
+	out, err := exec.Command("nft", "list", "chain", NFT_TABLE, "input").Output()
+	if err != nil {
+		return err
+	}
+	if strings.Contains(string(out), "iifname \"" + bridge + "\"") {
+		return nil
+	}
+	return nftDo(nftLocalnetRule(bridge))
+}
+
+func nftLocalnetRule(bridge string) string {
+	return "add rule " + NFT_TABLE + " input iifname \"" + bridge + "\" ip daddr 127.0.0.0/8 ct status & dnat == 0 drop"
+}
+
+func (b nftablesBackend) forwardPort(c *Container) error {
+	if err := ensureNftTable(); err != nil {
+		return err
+	}
+	if err := ensureNftLocalnetRule(c.Bridge); err != nil {
+		return err
+	}
+	if b.portForwarded(c) {
+		return errors.New("Trying to add nftables port " + strconv.Itoa(c.HostPort) + " that already exists")
+	}
+	if err := enableRouteLocalnet(c.Bridge); err != nil {
+		return err
+	}
+	//subnets are shared between containers, never removed
+	subnets := []string{"add element " + NFT_TABLE + " subnets4 { " + c.Subnet + " }"}
+	if c.HasIp6() {
+		subnets = append(subnets, "add element " + NFT_TABLE + " subnets6 { " + c.Subnet6 + " }")
+	}
+	for _, statement := range append(subnets, c.nftPortElements("add")...) {
+		if err := nftDo(statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//only removes the elements present
+func (b nftablesBackend) unforwardPort(c *Container) error {
+	if c.HostPort == 0 {
+		return nil
+	}
+	for _, statement := range c.nftPortElements("delete") {
+		get := strings.Replace(statement, "delete", "get", 1)
+		if nftDo(get) != nil {
+			continue
+		}
+		if err := nftDo(statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b nftablesBackend) portForwarded(c *Container) bool {
+	return nftDo("get element " + NFT_TABLE + " ports4 { " + strconv.Itoa(c.HostPort) + " }") == nil
+}
+
+func (c *Container) nftComment() string {
+	return "comment \"thin-lxc:" + c.Name + "\""
+}
+
+func (c *Container) nftChain() string {
+	return "container-" + c.Name
+}
+
+func nftFamily(ip6 bool) string {
+	if ip6 {
+		return "ip6"
+	}
+	return "ip"
+}
+
+//container chain rules in order, ipv4 then ipv6
+func (c *Container) nftPolicyRules() []string {
+	rules := []string{}
+	for _, ip6 := range c.policyFamilies() {
+		family, addr := nftFamily(ip6), c.policyAddress(ip6)
+		for _, r := range c.policyRules(ip6) {
+			rule, peer := []string{family + " daddr " + addr}, family + " saddr "
+			if r.egress {
+				rule, peer = []string{family + " saddr " + addr}, family + " daddr "
+			}
+			if len(r.peer) > 0 {
+				rule = append(rule, peer + r.peer)
+			}
+			if r.port > 0 {
+				rule = append(rule, r.proto + " dport " + strconv.Itoa(r.port))
+			}
+			switch r.state {
+			case "ESTABLISHED,RELATED":
+				rule = append(rule, "ct state established,related")
+			case "DNAT":
+				rule = append(rule, "ct status dnat")
+			}
+			rules = append(rules, strings.Join(append(rule, strings.ToLower(r.verdict)), " "))
+		}
+	}
+	return rules
+}
+
+//forward chain rules, to and from the container
+func (c *Container) nftPolicyJumps() []string {
+	jumps := []string{}
+	for _, ip6 := range c.policyFamilies() {
+		family, addr := nftFamily(ip6), c.policyAddress(ip6)
+		for _, match := range []string{" daddr ", " saddr "} {
+			jumps = append(jumps, family + match + addr + " jump " + c.nftChain() + " " + c.nftComment())
+		}
+	}
+	return jumps
+}
+
+//handles of the container jumps in the forward chain
+func (c *Container) nftPolicyHandles() ([]string, error) {
+	out, err := exec.Command("nft", "-a", "list", "chain", NFT_TABLE, "forward").Output()
+	if err != nil {
+		return nil, err
+	}
+	handles := []string{}
+	handle := regexp.MustCompile(`# handle (\d+)$`)
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.Contains(line, c.nftComment()) == false {
+			continue
+		}
+		if m := handle.FindStringSubmatch(line); m != nil {
+			handles = append(handles, m[1])
+		}
+	}
+	return handles, nil
+}
+
+//the whole set of rules in one transaction, as they can't be checked one by one like with iptables -C
+func (b nftablesBackend) applyPolicy(c *Container) error {
+	if err := ensureNftTable(); err != nil {
+		return err
+	}
+	if handles, err := c.nftPolicyHandles(); err != nil || len(handles) > 0 {
+		return err
+	}
+	chain := NFT_TABLE + " " + c.nftChain()
+	script := []string{"add chain " + chain, "flush chain " + chain}
+	for _, rule := range c.nftPolicyRules() {
+		script = append(script, "add rule " + chain + " " + rule)
+	}
+	for _, jump := range c.nftPolicyJumps() {
+		script = append(script, "add rule " + NFT_TABLE + " forward " + jump)
+	}
+	return nftScript(strings.Join(script, "\n") + "\n")
+}
+
+//jumps first, then the chain
+func (b nftablesBackend) removePolicy(c *Container) error {
+	if nftDo("list table " + NFT_TABLE) != nil {
+		return nil
+	}
+	handles, err := c.nftPolicyHandles()
+	if err != nil {
+		return err
+	}
+	for _, handle := range handles {
+		if err := nftDo("delete rule " + NFT_TABLE + " forward handle " + handle); err != nil {
+			return err
+		}
+	}
+	if nftDo("list chain " + NFT_TABLE + " " + c.nftChain()) != nil {
+		return nil
+	}
+	return nftDo("delete chain " + NFT_TABLE + " " + c.nftChain())
+}
+
+func (b nftablesBackend) flush(containers []*Container) error {
+	if nftDo("list table " + NFT_TABLE) != nil {
+		return nil
+	}
+	return nftDo("delete table " + NFT_TABLE)
+}
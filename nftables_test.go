@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func Test_nftablesRules(t *testing.T) {
+	fmt.Print("Testing nftables rules ... ")
+	if selectFirewall(FIREWALL_NFTABLES) != FIREWALL_NFTABLES || selectFirewall(FIREWALL_IPTABLES) != FIREWALL_IPTABLES {
+		failTest(t, "configured firewall not kept")
+	}
+	if (&Container{}).firewall() != firewallBackends[FIREWALL_IPTABLES] {
+		failTest(t, "containers without backend should use iptables")
+	}
+
+	c := &Container{Name: "web", Ip: "10.0.3.12", Subnet: DEFAULT_SUBNET, Port: 80, HostPort: 8080, FirewallBackend: FIREWALL_NFTABLES}
+	elements := c.nftPortElements("add")
+	if len(elements) != 2 || elements[0] != "add element inet thin-lxc ports4 { 8080 : 10.0.3.12 . 80 }" || elements[1] != "add element inet thin-lxc published4 { 10.0.3.12 . 80 }" {
+		failTest(t, "unexpected port elements", elements)
+	}
+	c.Ip6, c.Subnet6 = "fd00:10:0:3::12", "fd00:10:0:3::/64"
+	if elements := c.nftPortElements("delete"); len(elements) != 4 || strings.HasPrefix(elements[2], "delete element inet thin-lxc ports6") == false {
+		failTest(t, "ipv6 elements missing", elements)
+	}
+
+	c.Ip6, c.Subnet6 = "", ""
+	c.Firewall = FirewallPolicy{Egress: POLICY_DENY, AllowOut: []string{":53/udp"}}
+	expected := []string{
+		`ip saddr 10.0.3.12 ct state established,related return`,
+		`ip saddr 10.0.3.12 udp dport 53 return`,
+		`ip saddr 10.0.3.12 drop`,
+		`ip daddr 10.0.3.12 ct state established,related return`,
+		`ip daddr 10.0.3.12 tcp dport 80 ct status dnat return`,
+	}
+	if rules := c.nftPolicyRules(); strings.Join(rules, "\n") != strings.Join(expected, "\n") {
+		failTest(t, "unexpected policy rules", rules)
+	}
+	c.Ip6, c.Subnet6 = "fd00:10:0:3::12", "fd00:10:0:3::/64"
+	if rules := c.nftPolicyRules(); len(rules) != 10 || rules[5] != `ip6 saddr fd00:10:0:3::12 ct state established,related return` {
+		failTest(t, "ipv6 policy rules missing", rules)
+	}
+	jumps := []string{
+		`ip daddr 10.0.3.12 jump container-web comment "thin-lxc:web"`,
+		`ip saddr 10.0.3.12 jump container-web comment "thin-lxc:web"`,
+		`ip6 daddr fd00:10:0:3::12 jump container-web comment "thin-lxc:web"`,
+		`ip6 saddr fd00:10:0:3::12 jump container-web comment "thin-lxc:web"`,
+	}
+	if rules := c.nftPolicyJumps(); strings.Join(rules, "\n") != strings.Join(jumps, "\n") {
+		failTest(t, "unexpected policy jumps", rules)
+	}
+	fmt.Println("OK")
+}
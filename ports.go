@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const PROC_NET = "/proc/net"
+const DEFAULT_PORT_RANGE = "49152-65535"
+
+/*
+Host ports. A host port is free if no other container publishes it (with the same protocol) and
+no host socket listens on it, on any address: DNAT also applies to connections to localhost.
+-p :8080 publishes the container port 8080 on the first free host port of port_range.
+*/
+
+func (c *Container) portProto() string {
+	if len(c.PortProto) == 0 {
+		return "tcp"
+	}
+	return c.PortProto
+}
+
+//"49152-65535"
+func parsePortRange(r string) (int, int, error) {
+	arr := strings.Split(r, "-")
+	if len(arr) != 2 {
+		return 0, 0, errors.New("Invalid port range " + r)
+	}
+	first, err1 := strconv.Atoi(strings.TrimSpace(arr[0]))
+	last, err2 := strconv.Atoi(strings.TrimSpace(arr[1]))
+	if err1 != nil || err2 != nil || first <= 0 || last > 65535 || first > last {
+		return 0, 0, errors.New("Invalid port range " + r)
+	}
+	return first, last, nil
+}
+
+//ports of the host sockets listening (tcp) or bound (udp), from /proc/net/<proto>{,6}
+func listeningPorts(procNet string, proto string) map[int]bool {
+	//st column: 0A is TCP_LISTEN, 07 is TCP_CLOSE, the state of bound udp sockets
+	state := "0A"
+	if proto == "udp" {
+		state = "07"
+	}
+	ports := make(map[int]bool)
+	for _, file := range []string{proto, proto + "6"} {
+		f, err := os.Open(procNet + "/" + file)
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Scan() //header
+		for scanner.Scan() {
+			//sl local_address rem_address st ...
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 4 || fields[3] != state {
+				continue
+			}
+			i := strings.LastIndex(fields[1], ":")
+			if port, err := strconv.ParseInt(fields[1][i+1:], 16, 32); err == nil && i >= 0 {
+				ports[int(port)] = true
+			}
+		}
+		f.Close()
+	}
+	return ports
+}
+
+//why the host port can't be published, empty if free
+func hostPortTaken(port int, proto string, name string, containers []*Container, listening map[int]bool) string {
+	for _, other := range containers {
+		if other.Name != name && other.HostPort == port && other.portProto() == proto {
+			return "published by " + other.Name
+		}
+	}
+	if listening[port] {
+		return "a host service listens on it"
+	}
+	return ""
+}
+
+func (c *Container) checkHostPort(containers []*Container) error {
+	if c.HostPort == 0 {
+		return nil
+	}
+	if reason := hostPortTaken(c.HostPort, c.portProto(), c.Name, containers, listeningPorts(PROC_NET, c.portProto())); len(reason) > 0 {
+		return fmt.Errorf("Host port %d/%s is not available, %s", c.HostPort, c.portProto(), reason)
+	}
+	return nil
+}
+
+//-p :port
+func (c *Container) assignHostPort(containers []*Container) error {
+	first, last, err := parsePortRange(config.PortRange)
+	if err != nil {
+		return err
+	}
+	listening := listeningPorts(PROC_NET, c.portProto())
+	for port := first; port <= last; port++ {
+		if hostPortTaken(port, c.portProto(), c.Name, containers, listening) == "" {
+			c.HostPort = port
+			return nil
+		}
+	}
+	return errors.New("No free host port left in " + config.PortRange)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func Test_hostPorts(t *testing.T) {
+	fmt.Print("Testing host port conflicts ... ")
+	if _, _, err := parsePortRange("9000-8000"); err == nil {
+		failTest(t, "invalid port range should fail")
+	}
+
+	procNet, _ := ioutil.TempDir("", "thin-lxc-proc-net")
+	defer os.RemoveAll(procNet)
+	header := "  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n"
+	//listening on 127.0.0.1:3000 (0BB8) and [::]:49152 (C000), connected from 8080 (1F90)
+	ioutil.WriteFile(procNet+"/tcp", []byte(header+
+		"   0: 0100007F:0BB8 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 662 1\n"+
+		"   1: 0100007F:1F90 0100007F:B14F 01 00000000:00000000 00:00000000 00000000     0        0 663 1\n"), 0644)
+	ioutil.WriteFile(procNet+"/tcp6", []byte(header+
+		"   0: 00000000000000000000000000000000:C000 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 664 1\n"), 0644)
+	listening := listeningPorts(procNet, "tcp")
+	if len(listening) != 2 || listening[3000] == false || listening[49152] == false {
+		failTest(t, "listening ports not read", listening)
+	}
+	if udp := listeningPorts(procNet, "udp"); len(udp) != 0 {
+		failTest(t, "no udp socket expected", udp)
+	}
+
+	containers := []*Container{
+		{Name: "web", HostPort: 8080, Port: 80},
+		{Name: "dns", HostPort: 5353, Port: 53, PortProto: "udp"},
+	}
+	if reason := hostPortTaken(8080, "tcp", "api", containers, listening); reason != "published by web" {
+		failTest(t, "port of another container should be taken", reason)
+	}
+	if reason := hostPortTaken(8080, "tcp", "web", containers, listening); reason != "" {
+		failTest(t, "a container doesn't conflict with itself", reason)
+	}
+	if reason := hostPortTaken(5353, "tcp", "api", containers, listening); reason != "" {
+		failTest(t, "different protocols don't conflict", reason)
+	}
+	if reason := hostPortTaken(3000, "tcp", "api", containers, listening); reason == "" {
+		failTest(t, "port of a host service should be taken")
+	}
+	fmt.Println("OK")
+}
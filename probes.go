@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const PROBE_IP = "ip"
+const PROBE_TCP = "tcp"
+const PROBE_HTTP = "http"
+const PROBE_EXEC = "exec"
+
+const PROBE_INTERVAL = 500 * time.Millisecond
+const PROBE_CHECK_TIMEOUT = 2 * time.Second
+
+/*
+Readiness probes, given at creation (-probe, repeatable) and saved in the metadata. Once the
+container runs, start checks them in order until each passes, within its timeout:
+
+ip                  the guest has an address on its subnet
+tcp:5432            the port accepts connections
+http:8080/health    GET returns 2xx
+exec:pg_isready     the command (sh -c, through lxc-attach) exits 0
+*/
+
+type Probe struct {
+	Type string
+	Port int
+	Path string
+	Command string
+}
+
+func parseProbe(spec string) (*Probe, error) {
+	kv := strings.SplitN(spec, ":", 2)
+	p := &Probe{Type: kv[0]}
+	switch {
+	case p.Type == PROBE_IP && len(kv) == 1:
+		return p, nil
+	case p.Type == PROBE_EXEC && len(kv) == 2 && len(strings.TrimSpace(kv[1])) > 0:
+		p.Command = kv[1]
+		return p, nil
+	case (p.Type == PROBE_TCP || p.Type == PROBE_HTTP) && len(kv) == 2:
+		port := kv[1]
+		if i := strings.Index(port, "/"); i >= 0 && p.Type == PROBE_HTTP {
+			port, p.Path = port[:i], port[i:]
+		}
+		var err error
+		if p.Port, err = strconv.Atoi(port); err != nil || p.Port <= 0 || p.Port > 65535 {
+			return nil, errors.New("Invalid probe port " + spec)
+		}
+		return p, nil
+	}
+	return nil, errors.New("Invalid probe " + spec + " (ip, tcp:port, http:port/path or exec:command)")
+}
+
+func (c *Container) setProbes(specs []string) error {
+	for _, spec := range specs {
+		p, err := parseProbe(spec)
+		if err != nil {
+			return err
+		}
+		if p.Type != PROBE_EXEC && c.HasNetwork() == false {
+			return errors.New("Probe " + spec + " needs a network")
+		}
+		c.Probes = append(c.Probes, p)
+	}
+	return nil
+}
+
+func (p *Probe) String() string {
+	switch p.Type {
+	case PROBE_TCP:
+		return p.Type + ":" + strconv.Itoa(p.Port)
+	case PROBE_HTTP:
+		return p.Type + ":" + strconv.Itoa(p.Port) + p.Path
+	case PROBE_EXEC:
+		return p.Type + ":" + p.Command
+	}
+	return p.Type
+}
+
+func (p *Probe) check(ctx context.Context, c *Container) error {
+	if p.Type == PROBE_EXEC {
+		code, err := c.runtime().attach(ctx, c, []string{"/bin/sh", "-c", p.Command}, attachOptions{})
+		if err == nil && code != 0 {
+			err = fmt.Errorf("exit code %d", code)
+		}
+		return err
+	}
+	if p.Type == PROBE_IP {
+		//as lxc-info sees it, not the configured or reserved address
+		if len(c.runningIp()) == 0 {
+			return errors.New("no address yet")
+		}
+		return nil
+	}
+	address := c.resolveAddress()
+	if len(address) == 0 {
+		return errors.New("address unknown")
+	}
+	host := net.JoinHostPort(address, strconv.Itoa(p.Port))
+	if p.Type == PROBE_TCP {
+		conn, err := net.DialTimeout("tcp", host, PROBE_CHECK_TIMEOUT)
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+	req, err := http.NewRequest("GET", "http://" + host + p.Path, nil)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: PROBE_CHECK_TIMEOUT}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.New("status " + resp.Status)
+	}
+	return nil
+}
+
+//checks until it passes, the error tells which probe failed and its last error
+func (p *Probe) wait(ctx context.Context, c *Container) error {
+	for {
+		err := p.check(ctx, c)
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("Probe %s of %s failed: %v", p, c.Name, err)
+		case <-time.After(PROBE_INTERVAL):
+		}
+	}
+}
+
+//every probe, in order
+func (c *Container) waitReady(ctx context.Context) error {
+	for _, p := range c.Probes {
+		if err := p.wait(ctx, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
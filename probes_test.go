@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_probes(t *testing.T) {
+	fmt.Print("Testing readiness probes ... ")
+	for _, spec := range []string{"ip", "tcp:5432", "http:8080/health", "exec:pg_isready -U postgres"} {
+		p, err := parseProbe(spec)
+		if err != nil || p.String() != spec {
+			failTest(t, "probe not parsed", spec, p, err)
+		}
+	}
+	for _, spec := range []string{"ip:80", "tcp", "tcp:http", "http:0/", "exec:", "dns:53"} {
+		if _, err := parseProbe(spec); err == nil {
+			failTest(t, "invalid probe should fail", spec)
+		}
+	}
+	if err := (&Container{NetworkType: NET_TYPE_NONE}).setProbes([]string{"tcp:80"}); err == nil {
+		failTest(t, "network probe without network should fail")
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	c := &Container{Name: "web", Ip: "127.0.0.1"}
+	if err := c.setProbes([]string{"tcp:" + port, "http:" + port + "/health"}); err != nil {
+		failTest(t, "probes should be valid", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+	if err := c.waitReady(ctx); err != nil {
+		failTest(t, "probes should pass", err)
+	}
+
+	c.Probes = nil
+	c.setProbes([]string{"tcp:" + port, "http:" + port + "/ready"})
+	short, cancelShort := context.WithTimeout(context.Background(), time.Second)
+	defer cancelShort()
+	if err := c.waitReady(short); err == nil || strings.Contains(err.Error(), "Probe http:" + port + "/ready of web failed") == false {
+		failTest(t, "failing probe should be reported", err)
+	}
+	fmt.Println("OK")
+}
+
+//alive and not a zombie
+func processRunning(pid string) bool {
+	stat, err := ioutil.ReadFile("/proc/" + pid + "/stat")
+	return err == nil && strings.Contains(string(stat), ") Z ") == false
+}
+
+func Test_execProbeTimeout(t *testing.T) {
+	fmt.Print("Testing exec probe timeout ... ")
+	dir, err := ioutil.TempDir("", "thin-lxc-probe")
+	if err != nil {
+		failTest(t, "Temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+	//hanging command, its pid written once started
+	script := "#!/bin/sh\nsleep 30 &\necho $! > " + dir + "/sleep.pid\nwait\n"
+	if err := ioutil.WriteFile(dir + "/lxc-attach", []byte(script), 0755); err != nil {
+		failTest(t, "Fake lxc-attach", err)
+	}
+	path := os.Getenv("PATH")
+	defer os.Setenv("PATH", path)
+	os.Setenv("PATH", dir + ":" + path)
+
+	c := &Container{Name: "db"}
+	c.setProbes([]string{"exec:pg_isready"})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	started := time.Now()
+	if err := c.waitReady(ctx); err == nil || strings.Contains(err.Error(), "Probe exec:pg_isready of db failed") == false {
+		failTest(t, "hanging probe should fail", err)
+	}
+	if elapsed := time.Since(started); elapsed > 3 * time.Second {
+		failTest(t, "hanging probe should stop at the timeout", elapsed)
+	}
+	pid, _ := ioutil.ReadFile(dir + "/sleep.pid")
+	time.Sleep(100 * time.Millisecond)
+	if len(pid) == 0 || processRunning(strings.TrimSpace(string(pid))) {
+		failTest(t, "attached command should be killed", string(pid))
+	}
+	fmt.Println("OK")
+}
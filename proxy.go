@@ -0,0 +1,373 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	PORT_MODE_NAT = "nat"     //firewall DNAT, the default
+	PORT_MODE_PROXY = "proxy" //userland proxy
+)
+
+const DEFAULT_PROXY_MAX_CONNS = 256
+const PROXY_UDP_TIMEOUT = 60 * time.Second
+const PROXY_STOP_TIMEOUT = 10 * time.Second
+const PROXY_RESTART_MAX = time.Minute
+const PROXY_RESTART_ATTEMPTS = 5 //in a row, for errors restarting won't fix
+
+//doubled after each failed run, variable so tests don't have to wait
+var proxyBackoff = 1 * time.Second
+
+/*
+Userland proxy (-proxy), for hosts where the firewall can't be touched. A thin-lxc process
+(-a proxy, started detached by create and reload, pid in <root>/<name>/.proxy.pid) listens on the
+host port and relays TCP connections or UDP datagrams to the container. At most ProxyMaxConns
+connections (UDP clients) are relayed at once, others are refused. SIGTERM (destroy) stops
+accepting and waits for the relayed connections, up to PROXY_STOP_TIMEOUT.
+*/
+
+//"8080:80/udp" -> "8080:80", "udp"
+func splitPortProto(ports string) (string, string, error) {
+	arr := strings.SplitN(ports, "/", 2)
+	if len(arr) == 1 {
+		return ports, "tcp", nil
+	}
+	if arr[1] != "tcp" && arr[1] != "udp" {
+		return "", "", errors.New("Invalid protocol " + arr[1] + " in " + ports + ", expected tcp or udp")
+	}
+	return arr[0], arr[1], nil
+}
+
+func (c *Container) setPortMode(proxy bool, proto string, maxConns int) error {
+	if proxy == false {
+		if proto != "tcp" {
+			return errors.New("Only tcp ports can be forwarded by the firewall, use -proxy for " + proto)
+		}
+		return nil
+	}
+	c.PortMode, c.PortProto, c.ProxyMaxConns = PORT_MODE_PROXY, proto, maxConns
+	return nil
+}
+
+func (c *Container) hasProxy() bool {
+	return c.PortMode == PORT_MODE_PROXY && c.HostPort > 0
+}
+
+func (c *Container) proxyPidFile() string {
+	return c.Path + "/.proxy.pid"
+}
+
+//pid of the running proxy, 0 if none
+func (c *Container) proxyPid() int {
+	b, err := ioutil.ReadFile(c.proxyPidFile())
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || syscall.Kill(pid, 0) != nil || c.isProxyProcess(pid) == false {
+		return 0
+	}
+	return pid
+}
+
+//the pid file outlives reboots and crashes, its pid may now be another process
+func (c *Container) isProxyProcess(pid int) bool {
+	proc := "/proc/" + strconv.Itoa(pid)
+	exe, err := os.Readlink(proc + "/exe")
+	if err != nil {
+		return false
+	}
+	self, err := os.Executable()
+	//binary replaced by an upgrade since the proxy started
+	if err != nil || strings.TrimSuffix(exe, " (deleted)") != strings.TrimSuffix(self, " (deleted)") {
+		return false
+	}
+	cmdline, err := ioutil.ReadFile(proc + "/cmdline")
+	if err != nil {
+		return false
+	}
+	return isProxyCommand(strings.Split(strings.TrimSuffix(string(cmdline), "\x00"), "\x00"), c.Name)
+}
+
+//-a proxy -n <name>, as started by startProxy
+func isProxyCommand(args []string, name string) bool {
+	action, container := "", ""
+	for i := 0; i+1 < len(args); i++ {
+		switch args[i] {
+		case "-a":
+			action = args[i+1]
+		case "-n":
+			container = args[i+1]
+		}
+	}
+	return action == "proxy" && container == name
+}
+
+func (c *Container) startProxy() error {
+	if c.proxyPid() > 0 {
+		return nil
+	}
+	logFile, err := os.OpenFile(c.Path + "/.proxy.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+	cmd := exec.Command("/proc/self/exe", "-a", "proxy", "-n", c.Name, "-c", *cFlag, "-r", c.RootPath)
+	cmd.Stdout, cmd.Stderr = logFile, logFile
+	//own session, it outlives this command
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(c.proxyPidFile(), []byte(strconv.Itoa(cmd.Process.Pid) + "\n"), 0644); err != nil {
+		cmd.Process.Kill()
+		return err
+	}
+	return cmd.Process.Release()
+}
+
+func (c *Container) stopProxy() error {
+	pid := c.proxyPid()
+	if pid > 0 {
+		if err := syscall.Kill(pid, syscall.SIGTERM); err != nil {
+			return err
+		}
+		deadline := time.Now().Add(PROXY_STOP_TIMEOUT + time.Second)
+		for c.proxyPid() > 0 && time.Now().Before(deadline) {
+			time.Sleep(100 * time.Millisecond)
+		}
+		if c.proxyPid() > 0 {
+			syscall.Kill(pid, syscall.SIGKILL)
+		}
+	}
+	if err := os.Remove(c.proxyPidFile()); err != nil && os.IsNotExist(err) == false {
+		return err
+	}
+	return nil
+}
+
+type portProxy struct {
+	target string
+	maxConns int
+	stop chan struct{}
+	wg sync.WaitGroup
+}
+
+func newPortProxy(target string, maxConns int) *portProxy {
+	if maxConns <= 0 {
+		maxConns = DEFAULT_PROXY_MAX_CONNS
+	}
+	return &portProxy{target: target, maxConns: maxConns, stop: make(chan struct{})}
+}
+
+func (p *portProxy) stopped() bool {
+	select {
+	case <-p.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *portProxy) serveTCP(l net.Listener) error {
+	slots := make(chan struct{}, p.maxConns)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if p.stopped() {
+				return nil
+			}
+			return err
+		}
+		select {
+		case slots <- struct{}{}:
+		default:
+			log.Println("Connection from", conn.RemoteAddr(), "refused, limit of", p.maxConns, "reached")
+			conn.Close()
+			continue
+		}
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			defer func() { <-slots }()
+			p.relayTCP(conn)
+		}()
+	}
+}
+
+func (p *portProxy) relayTCP(conn net.Conn) {
+	defer conn.Close()
+	upstream, err := net.DialTimeout("tcp", p.target, 10 * time.Second)
+	if err != nil {
+		log.Println("Unable to reach", p.target, err)
+		return
+	}
+	defer upstream.Close()
+	done := make(chan struct{}, 2)
+	pipe := func(dst net.Conn, src net.Conn) {
+		io.Copy(dst, src)
+		//half close, the other direction may still have data
+		if tcp, ok := dst.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		}
+		done <- struct{}{}
+	}
+	go pipe(upstream, conn)
+	go pipe(conn, upstream)
+	<-done
+	<-done
+}
+
+//one upstream socket per client address, closed after PROXY_UDP_TIMEOUT without reply
+func (p *portProxy) serveUDP(pc net.PacketConn) error {
+	var mu sync.Mutex
+	sessions := make(map[string]net.Conn)
+	buf := make([]byte, 65535)
+	for {
+		n, client, err := pc.ReadFrom(buf)
+		if err != nil {
+			//no connection to wait for, sessions end now
+			mu.Lock()
+			for _, upstream := range sessions {
+				upstream.Close()
+			}
+			mu.Unlock()
+			if p.stopped() {
+				return nil
+			}
+			return err
+		}
+		mu.Lock()
+		upstream, ok := sessions[client.String()]
+		if ok == false {
+			if len(sessions) >= p.maxConns {
+				mu.Unlock()
+				log.Println("Datagram from", client, "dropped, limit of", p.maxConns, "reached")
+				continue
+			}
+			if upstream, err = net.Dial("udp", p.target); err != nil {
+				mu.Unlock()
+				log.Println("Unable to reach", p.target, err)
+				continue
+			}
+			sessions[client.String()] = upstream
+			p.wg.Add(1)
+			go func(client net.Addr, upstream net.Conn) {
+				defer p.wg.Done()
+				reply := make([]byte, 65535)
+				for {
+					upstream.SetReadDeadline(time.Now().Add(PROXY_UDP_TIMEOUT))
+					n, err := upstream.Read(reply)
+					if err != nil {
+						break
+					}
+					pc.WriteTo(reply[:n], client)
+				}
+				mu.Lock()
+				delete(sessions, client.String())
+				mu.Unlock()
+				upstream.Close()
+			}(client, upstream)
+		}
+		mu.Unlock()
+		upstream.Write(buf[:n])
+	}
+}
+
+//SIGTERM: stop accepting, wait for relayed connections up to PROXY_STOP_TIMEOUT
+func (p *portProxy) waitForStop(closer io.Closer) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	<-signals
+	close(p.stop)
+	closer.Close()
+}
+
+func (p *portProxy) drain() {
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(PROXY_STOP_TIMEOUT):
+		log.Println("Connections still open after", PROXY_STOP_TIMEOUT, "exiting anyway")
+	}
+}
+
+func (c *Container) runProxy() error {
+	if len(c.Address()) == 0 {
+		return errors.New("No address known for " + c.Name)
+	}
+	p := newPortProxy(net.JoinHostPort(c.Address(), strconv.Itoa(c.Port)), c.ProxyMaxConns)
+	listen := ":" + strconv.Itoa(c.HostPort)
+	var err error
+	if c.PortProto == "udp" {
+		pc, lerr := net.ListenPacket("udp", listen)
+		if lerr != nil {
+			return lerr
+		}
+		go p.waitForStop(pc)
+		err = p.serveUDP(pc)
+	} else {
+		l, lerr := net.Listen("tcp", listen)
+		if lerr != nil {
+			return lerr
+		}
+		go p.waitForStop(l)
+		err = p.serveTCP(l)
+	}
+	p.drain()
+	return err
+}
+
+//host port taken or not allowed, a few attempts in case the previous proxy is still exiting
+func permanentProxyError(err error) bool {
+	return errors.Is(err, syscall.EADDRINUSE) || errors.Is(err, syscall.EACCES) || errors.Is(err, syscall.EADDRNOTAVAIL)
+}
+
+/*
+Restarts run until it returns nil, waiting proxyBackoff doubled after each failure up to
+PROXY_RESTART_MAX. The wait is reset once a run lasted PROXY_RESTART_MAX. Gives up after
+PROXY_RESTART_ATTEMPTS permanent errors in a row.
+*/
+func superviseProxy(name string, run func() error) error {
+	backoff := proxyBackoff
+	permanent := 0
+	for {
+		started := time.Now()
+		err := run()
+		if err == nil {
+			return nil
+		}
+		if time.Since(started) >= PROXY_RESTART_MAX {
+			backoff, permanent = proxyBackoff, 0
+		}
+		if permanentProxyError(err) {
+			permanent++
+			if permanent >= PROXY_RESTART_ATTEMPTS {
+				return errors.New("Proxy of " + name + " failed " + strconv.Itoa(permanent) + " times in a row, giving up: " + err.Error())
+			}
+		} else {
+			permanent = 0
+		}
+		log.Println("Proxy of", name, "failed, restarting in", backoff, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > PROXY_RESTART_MAX {
+			backoff = PROXY_RESTART_MAX
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+//echoes lines back
+func echoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					fmt.Fprintln(conn, scanner.Text())
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+func Test_portProxy(t *testing.T) {
+	fmt.Print("Testing userland proxy ... ")
+	if ports, proto, err := splitPortProto("5353:53/udp"); err != nil || ports != "5353:53" || proto != "udp" {
+		failTest(t, "port protocol parsing failed", ports, proto, err)
+	}
+	if _, _, err := splitPortProto("5353:53/sctp"); err == nil {
+		failTest(t, "unknown protocol should fail")
+	}
+	if err := (&Container{}).setPortMode(false, "udp", 0); err == nil {
+		failTest(t, "udp without proxy should fail")
+	}
+
+	upstream := echoServer(t)
+	defer upstream.Close()
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	p := newPortProxy(upstream.Addr().String(), 1)
+	stopped := make(chan error)
+	go func() { stopped <- p.serveTCP(l) }()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		failTest(t, "unable to connect to the proxy", err)
+	}
+	fmt.Fprintln(conn, "hello")
+	if line, err := bufio.NewReader(conn).ReadString('\n'); err != nil || line != "hello\n" {
+		failTest(t, "not relayed", line, err)
+	}
+
+	//limit of 1 connection reached, refused
+	refused, _ := net.Dial("tcp", l.Addr().String())
+	refused.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := refused.Read(make([]byte, 1)); err == nil {
+		failTest(t, "connection over the limit should be closed")
+	}
+	refused.Close()
+
+	close(p.stop)
+	l.Close()
+	if err := <-stopped; err != nil {
+		failTest(t, "proxy should stop cleanly", err)
+	}
+	conn.Close()
+	p.drain()
+	fmt.Println("OK")
+}
+
+func Test_superviseProxy(t *testing.T) {
+	fmt.Print("Testing proxy restarts ... ")
+	proxyBackoff = time.Millisecond
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		failTest(t, "Listen", err)
+	}
+	defer l.Close()
+
+	//host port taken
+	runs := 0
+	err = superviseProxy("web", func() error {
+		runs++
+		_, err := net.Listen("tcp", l.Addr().String())
+		return err
+	})
+	if err == nil || runs != PROXY_RESTART_ATTEMPTS {
+		failTest(t, "address in use should give up", runs, err)
+	}
+
+	//other errors are retried until the proxy exits cleanly
+	runs = 0
+	err = superviseProxy("web", func() error {
+		runs++
+		if runs < PROXY_RESTART_ATTEMPTS * 2 {
+			return errors.New("No address known for web")
+		}
+		return nil
+	})
+	if err != nil || runs != PROXY_RESTART_ATTEMPTS * 2 {
+		failTest(t, "temporary errors should be retried", runs, err)
+	}
+	fmt.Println("OK")
+}
+
+func Test_proxyPid(t *testing.T) {
+	fmt.Print("Testing proxy pid file ... ")
+	if isProxyCommand([]string{"/usr/local/bin/thin-lxc", "-a", "proxy", "-n", "web", "-c", "", "-r", "/var/lib/thin-lxc"}, "web") == false {
+		failTest(t, "proxy command not recognized")
+	}
+	if isProxyCommand([]string{"/usr/local/bin/thin-lxc", "-a", "proxy", "-n", "web2"}, "web") || isProxyCommand([]string{"/usr/sbin/sshd", "-D"}, "web") {
+		failTest(t, "other commands should not be taken for the proxy")
+	}
+
+	dir, err := ioutil.TempDir("", "thin-lxc-proxy")
+	if err != nil {
+		failTest(t, "Temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+	c := &Container{Name: "web", Path: dir}
+	//stale pid file, the pid now belongs to another process (this test)
+	ioutil.WriteFile(c.proxyPidFile(), []byte(strconv.Itoa(os.Getpid()) + "\n"), 0644)
+	if pid := c.proxyPid(); pid != 0 {
+		failTest(t, "stale pid should not be taken for the proxy", pid)
+	}
+	fmt.Println("OK")
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const RUNTIME_CLI = "cli"
+const RUNTIME_LIBLXC = "liblxc"
+
+/*
+Runtime, how containers are driven once created. cli runs the lxc-* commands, liblxc (runtime_liblxc.go)
+uses the liblxc Go bindings and is only built with: go build -tags liblxc
+It is the default of such builds, runtime in config picks one explicitly.
+*/
+
+type attachOptions struct {
+	Env []string //KEY=value, added to the container environment
+	Cwd string   //empty for the default (/ or the home of the user)
+	Uid int      //0 for root
+	Gid int
+	Stdin *os.File
+	Stdout *os.File
+	Stderr *os.File
+}
+
+type containerRuntime interface {
+	state(c *Container) (string, error)
+	start(c *Container) error
+	stop(c *Container) error
+	freeze(c *Container) error
+	unfreeze(c *Container) error
+	//exit code of the command, killed once ctx is done
+	attach(ctx context.Context, c *Container, command []string, opts attachOptions) (int, error)
+	//init pid, in the host pid namespace
+	pid(c *Container) (int, error)
+}
+
+var runtimes = map[string]containerRuntime{
+	RUNTIME_CLI: cliRuntime{},
+}
+
+//changed by builds with other runtimes
+var defaultRuntime = RUNTIME_CLI
+
+func validRuntime(name string) error {
+	if _, ok := runtimes[name]; ok || len(name) == 0 {
+		return nil
+	}
+	if name == RUNTIME_LIBLXC {
+		return errors.New("runtime liblxc not built in (go build -tags liblxc)")
+	}
+	return errors.New("unknown runtime " + name + " (cli or liblxc)")
+}
+
+func (c *Container) runtime() containerRuntime {
+	if r, ok := runtimes[config.Runtime]; ok {
+		return r
+	}
+	return runtimes[defaultRuntime]
+}
+
+var lxcStates = map[string]bool{
+	C_STARTING: true,
+	C_RUNNING: true,
+	C_STOPPING: true,
+	C_STOPPED: true,
+	"ABORTING": true,
+	"FREEZING": true,
+	"FROZEN": true,
+	"THAWED": true,
+}
+
+//value of a single field lxc-info, with -H ("RUNNING") or without ("State:   RUNNING")
+func parseLxcInfoValue(out string) string {
+	value := strings.TrimSpace(out)
+	if i := strings.Index(value, "\n"); i >= 0 {
+		value = value[:i]
+	}
+	if i := strings.Index(value, ":"); i >= 0 {
+		value = value[i+1:]
+	}
+	return strings.TrimSpace(value)
+}
+
+func parseLxcInfoState(out string) (string, error) {
+	state := strings.ToUpper(parseLxcInfoValue(out))
+	if lxcStates[state] == false {
+		return C_UNKNOWN, errors.New("Unexpected lxc-info state " + strconv.Quote(out))
+	}
+	return state, nil
+}
+
+type cliRuntime struct{}
+
+func (r cliRuntime) state(c *Container) (string, error) {
+	stdout, err := exec.Command("lxc-info", "-n", c.Name, "-s", "-H").Output()
+	if err != nil {
+		return C_UNKNOWN, err
+	}
+	return parseLxcInfoState(string(stdout))
+}
+
+func (r cliRuntime) start(c *Container) error {
+	return runCmdWithDetailedError(exec.Command("lxc-start", "-n", c.Name, "-f", c.ConfigPath, "-d"))
+}
+
+func (r cliRuntime) stop(c *Container) error {
+	return runCmdWithDetailedError(exec.Command("lxc-stop", "-n", c.Name))
+}
+
+func (r cliRuntime) freeze(c *Container) error {
+	return runCmdWithDetailedError(exec.Command("lxc-freeze", "-n", c.Name))
+}
+
+func (r cliRuntime) unfreeze(c *Container) error {
+	return runCmdWithDetailedError(exec.Command("lxc-unfreeze", "-n", c.Name))
+}
+
+//lxc-attach has no working directory option, a shell changes it
+func attachArgs(name string, command []string, opts attachOptions) []string {
+	args := []string{"-n", name}
+	for _, env := range opts.Env {
+		args = append(args, "-v", env)
+	}
+	if opts.Uid != 0 || opts.Gid != 0 {
+		args = append(args, "--uid", strconv.Itoa(opts.Uid), "--gid", strconv.Itoa(opts.Gid))
+	}
+	args = append(args, "--")
+	if len(opts.Cwd) > 0 {
+		args = append(args, "/bin/sh", "-c", "cd \"$0\" && exec \"$@\"", opts.Cwd)
+	}
+	return append(args, command...)
+}
+
+/*
+Without a terminal the attached command stays in the process group of lxc-attach, it gets one of
+its own when ctx can be done so both are killed. Commands that can't be cancelled (exec) keep the
+foreground group for -tty.
+*/
+func (r cliRuntime) attach(ctx context.Context, c *Container, command []string, opts attachOptions) (int, error) {
+	cmd := exec.CommandContext(ctx, "lxc-attach", attachArgs(c.Name, command, opts)...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = opts.Stdin, opts.Stdout, opts.Stderr
+	if ctx.Done() != nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		cmd.Cancel = func() error {
+			return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		}
+		//output pipes held by what escaped the group
+		cmd.WaitDelay = time.Second
+	}
+	code, err := exitCode(cmd.Run())
+	if ctx.Err() != nil {
+		return -1, ctx.Err()
+	}
+	return code, err
+}
+
+//exit code of a finished command, 128 + signal if killed, err if it couldn't run
+func exitCode(err error) (int, error) {
+	if err == nil {
+		return 0, nil
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			return waitStatusCode(status), nil
+		}
+	}
+	return -1, err
+}
+
+func waitStatusCode(status syscall.WaitStatus) int {
+	if status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return status.ExitStatus()
+}
+
+func (r cliRuntime) pid(c *Container) (int, error) {
+	stdout, err := exec.Command("lxc-info", "-n", c.Name, "-p", "-H").Output()
+	if err != nil {
+		return 0, err
+	}
+	//empty when not running
+	pid, err := strconv.Atoi(parseLxcInfoValue(string(stdout)))
+	if err != nil {
+		return 0, errors.New("Container " + c.Name + " has no init process")
+	}
+	return pid, nil
+}
@@ -0,0 +1,155 @@
+//go:build liblxc
+// +build liblxc
+
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"syscall"
+	"time"
+
+	"gopkg.in/lxc/go-lxc.v2"
+)
+
+/*
+liblxc runtime, needs the liblxc headers (lxc-dev) and go get gopkg.in/lxc/go-lxc.v2
+*/
+
+func init() {
+	runtimes[RUNTIME_LIBLXC] = liblxcRuntime{}
+	defaultRuntime = RUNTIME_LIBLXC
+}
+
+type liblxcRuntime struct{}
+
+func (r liblxcRuntime) container(c *Container) (*lxc.Container, error) {
+	return lxc.NewContainer(c.Name, config.LxcPath)
+}
+
+func (r liblxcRuntime) state(c *Container) (string, error) {
+	ct, err := r.container(c)
+	if err != nil {
+		return C_UNKNOWN, err
+	}
+	defer lxc.Release(ct)
+	if ct.Defined() == false {
+		return C_UNKNOWN, errors.New("Container " + c.Name + " not defined in " + config.LxcPath)
+	}
+	return ct.State().String(), nil
+}
+
+func (r liblxcRuntime) start(c *Container) error {
+	ct, err := r.container(c)
+	if err != nil {
+		return err
+	}
+	defer lxc.Release(ct)
+	if err := ct.LoadConfigFile(c.ConfigPath); err != nil {
+		return err
+	}
+	ct.SetVerbosity(lxc.Quiet)
+	if err := ct.WantDaemonize(true); err != nil {
+		return err
+	}
+	return ct.Start()
+}
+
+func (r liblxcRuntime) stop(c *Container) error {
+	ct, err := r.container(c)
+	if err != nil {
+		return err
+	}
+	defer lxc.Release(ct)
+	return ct.Stop()
+}
+
+func (r liblxcRuntime) freeze(c *Container) error {
+	ct, err := r.container(c)
+	if err != nil {
+		return err
+	}
+	defer lxc.Release(ct)
+	return ct.Freeze()
+}
+
+func (r liblxcRuntime) unfreeze(c *Container) error {
+	ct, err := r.container(c)
+	if err != nil {
+		return err
+	}
+	defer lxc.Release(ct)
+	return ct.Unfreeze()
+}
+
+func (r liblxcRuntime) attach(ctx context.Context, c *Container, command []string, opts attachOptions) (int, error) {
+	ct, err := r.container(c)
+	if err != nil {
+		return -1, err
+	}
+	defer lxc.Release(ct)
+	options := lxc.DefaultAttachOptions
+	options.Env = opts.Env
+	options.Cwd = opts.Cwd
+	options.UID = opts.Uid
+	options.GID = opts.Gid
+	if opts.Stdin != nil {
+		options.StdinFd = opts.Stdin.Fd()
+	}
+	if opts.Stdout != nil {
+		options.StdoutFd = opts.Stdout.Fd()
+	}
+	if opts.Stderr != nil {
+		options.StderrFd = opts.Stderr.Fd()
+	}
+	//attached process, a child of this one
+	pid, err := ct.RunCommandNoWait(command, options)
+	if err != nil {
+		return -1, err
+	}
+	//killed once ctx is done, never after it was reaped (the pid could be reused)
+	var mutex sync.Mutex
+	exited := false
+	stop := context.AfterFunc(ctx, func() {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if exited == false {
+			syscall.Kill(pid, syscall.SIGKILL)
+		}
+	})
+	defer stop()
+	var status syscall.WaitStatus
+	for {
+		mutex.Lock()
+		//0 while it runs
+		var wpid int
+		wpid, err = syscall.Wait4(pid, &status, syscall.WNOHANG, nil)
+		exited = err == nil && wpid == pid
+		mutex.Unlock()
+		if err != nil {
+			return -1, err
+		}
+		if exited {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if ctx.Err() != nil {
+		return -1, ctx.Err()
+	}
+	return waitStatusCode(status), nil
+}
+
+func (r liblxcRuntime) pid(c *Container) (int, error) {
+	ct, err := r.container(c)
+	if err != nil {
+		return 0, err
+	}
+	defer lxc.Release(ct)
+	pid := ct.InitPid()
+	if pid <= 0 {
+		return 0, errors.New("Container " + c.Name + " has no init process")
+	}
+	return pid, nil
+}
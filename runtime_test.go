@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+type fakeRuntime struct {
+	cliRuntime
+	current string
+}
+
+func (r fakeRuntime) state(c *Container) (string, error) {
+	return r.current, nil
+}
+
+func Test_runtime(t *testing.T) {
+	fmt.Print("Testing runtimes ... ")
+	for out, expected := range map[string]string{"RUNNING\n": C_RUNNING, "State:          STOPPED\n": C_STOPPED, "frozen": "FROZEN"} {
+		if state, err := parseLxcInfoState(out); err != nil || state != expected {
+			failTest(t, "state not parsed", out, state, err)
+		}
+	}
+	for _, out := range []string{"", "web doesn't exist\n", "State:\n"} {
+		if state, err := parseLxcInfoState(out); err == nil || state != C_UNKNOWN {
+			failTest(t, "unexpected output should fail", out, state)
+		}
+	}
+	if pid := parseLxcInfoValue("PID:            1234\n"); pid != "1234" {
+		failTest(t, "pid not parsed", pid)
+	}
+	args := attachArgs("web", []string{"ls", "-l"}, attachOptions{Env: []string{"A=1"}, Cwd: "/srv"})
+	if len(args) != 11 || args[2] != "-v" || args[3] != "A=1" || args[9] != "ls" || args[8] != "/srv" {
+		failTest(t, "unexpected lxc-attach arguments", args)
+	}
+	args = attachArgs("web", []string{"id"}, attachOptions{Uid: 1000, Gid: 1000})
+	if len(args) != 8 || args[2] != "--uid" || args[3] != "1000" || args[5] != "1000" {
+		failTest(t, "unexpected lxc-attach user arguments", args)
+	}
+
+	if err := validRuntime("docker"); err == nil {
+		failTest(t, "unknown runtime should fail")
+	}
+	runtimes["fake"] = fakeRuntime{current: "FROZEN"}
+	defer delete(runtimes, "fake")
+	defer func() { config.Runtime = "" }()
+	config.Runtime = "fake"
+	if state := (&Container{Name: "web"}).state(); state != "FROZEN" {
+		failTest(t, "configured runtime should be used", state)
+	}
+	fmt.Println("OK")
+}
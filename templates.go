@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const TEMPLATE_DIR = "/etc/thin-lxc/templates"
+
+/*
+User templates. A template directory mirrors the container directory:
+
+<dir>/config              replaces the LXC config template
+<dir>/rootfs/etc/motd     rendered to /etc/motd in the container, replaces the built-in template if any
+
+Templates are Go templates executed with the Container as data, custom parameters given with
+-params are in .Params e.g: {{.Params.env}}. Directories are applied in order (host template dir,
+then -t), later ones win.
+*/
+
+type userTemplate struct {
+	content string
+	mode    os.FileMode
+}
+
+//"config" for the LXC config, absolute guest paths for the rest
+func (c *Container) userTemplates() (map[string]userTemplate, error) {
+	templates := make(map[string]userTemplate)
+	for _, dir := range c.TemplateDirs {
+		if fileExists(dir) == false {
+			continue
+		}
+		err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			rel, _ := filepath.Rel(dir, p)
+			key := ""
+			if rel == "config" {
+				key = rel
+			} else if strings.HasPrefix(rel, "rootfs/") {
+				key = strings.TrimPrefix(rel, "rootfs")
+			} else {
+				return errors.New("Template " + p + " is neither config nor under rootfs/")
+			}
+			b, err := ioutil.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			templates[key] = userTemplate{string(b), info.Mode().Perm()}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return templates, nil
+}
+
+func (c *Container) lxcConfigTemplate() (string, error) {
+	templates, err := c.userTemplates()
+	if err != nil {
+		return "", err
+	}
+	if t, ok := templates["config"]; ok {
+		return t.content, nil
+	}
+	return CONFIG_FILE, nil
+}
+
+//"key=value,key2=value2" -> map
+func parseParamsArg(params string) (map[string]string, error) {
+	m := make(map[string]string)
+	for _, kv := range splitList(params) {
+		arr := strings.SplitN(kv, "=", 2)
+		if len(arr) != 2 || len(arr[0]) == 0 {
+			return nil, errors.New("Invalid template parameter " + kv + ", expected key=value")
+		}
+		m[arr[0]] = arr[1]
+	}
+	return m, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func Test_userTemplates(t *testing.T) {
+	fmt.Print("Testing user templates ... ")
+	params, err := parseParamsArg("env=production, team=infra")
+	if err != nil || params["env"] != "production" || params["team"] != "infra" {
+		failTest(t, "params parsing failed", params, err)
+	}
+	if _, err := parseParamsArg("novalue"); err == nil {
+		failTest(t, "invalid param should fail")
+	}
+
+	dir, _ := ioutil.TempDir("", "thin-lxc-templates")
+	defer os.RemoveAll(dir)
+	hostDir, flagDir, roLayer := dir+"/host", dir+"/flag", dir+"/web"
+	os.MkdirAll(hostDir+"/rootfs/etc", 0755)
+	os.MkdirAll(flagDir+"/rootfs/etc", 0755)
+	os.MkdirAll(roLayer+"/rootfs", 0755)
+	ioutil.WriteFile(hostDir+"/config", []byte("lxc.utsname = {{.HostName}}\n"), 0644)
+	ioutil.WriteFile(hostDir+"/rootfs/etc/motd", []byte("host motd\n"), 0644)
+	ioutil.WriteFile(flagDir+"/rootfs/etc/motd", []byte("{{.Name}} ({{.Params.env}})\n"), 0600)
+	ioutil.WriteFile(flagDir+"/rootfs/etc/hostname", []byte("custom-{{.HostName}}\n"), 0644)
+
+	c := &Container{
+		Name: "web",
+		HostName: "web-host",
+		RoLayer: roLayer,
+		Rootfs: roLayer + "/rootfs",
+		ConfigPath: roLayer + "/config",
+		Subnet: DEFAULT_SUBNET,
+		Gateway: DEFAULT_GATEWAY,
+		NetworkConfig: NET_IFUPDOWN,
+		Init: INIT_UPSTART,
+		TemplateDirs: []string{hostDir, flagDir},
+		Params: params,
+	}
+	if err := c.configureFiles(); err != nil {
+		failTest(t, "configureFiles failed", err)
+	}
+
+	expected := map[string]string{
+		roLayer + "/config": "lxc.utsname = web-host\n",
+		c.Rootfs + "/etc/motd": "web (production)\n",
+		c.Rootfs + "/etc/hostname": "custom-web-host\n",
+	}
+	for path, content := range expected {
+		if b, _ := ioutil.ReadFile(path); string(b) != content {
+			failTest(t, path, "expected", content, "got", string(b))
+		}
+	}
+	if info, _ := os.Stat(c.Rootfs + "/etc/motd"); info.Mode().Perm() != 0600 {
+		failTest(t, "template mode not kept", info.Mode())
+	}
+	if fileExists(c.Rootfs + "/etc/network/interfaces") == false {
+		failTest(t, "built-in templates not rendered")
+	}
+	fmt.Println("OK")
+}
@@ -1,6 +1,7 @@
 package main
 
 import(
+	"context"
 	"flag"
 	"fmt"
 	"log"
@@ -11,20 +12,21 @@ import(
 	"strconv"
 	"strings"
 	"text/template"
-	"math/rand"
 	"time"
 	"path"
+	"path/filepath"
 	"errors"
-	"net/http"
-	"io"
-	"crypto/md5"
+	"regexp"
+	"text/tabwriter"
 )
 
 const VERSION = "0.4"
-const CONTAINERS_ROOT_PATH = "/containers"
+const CONTAINERS_ROOT_PATH = "/var/lib/thin-lxc"
+const LXC_PATH = "/var/lib/lxc"
+const LEGACY_ROOT_PATH = "/containers"
 
 /*
-LXC container state as returned by the lxc-info command
+LXC container states, the runtime (see runtime.go) reports others (FROZEN ...) as they are
 */
 const (
 	C_STARTING = "STARTING"
@@ -48,41 +50,118 @@ var aFlag = flag.String("a", "", "action to perform")
 var nFlag = flag.String("n", "", "name of the container")
 var hnFlag = flag.String("hn", "", "hostname of the container (hostname == name if name is nil)")
 var ipFlag = flag.String("ip", "", "ip of the container")
-var bFlag = flag.String("b", "/var/lib/lxc/baseCN", "path to the base container rootfs")
-var pFlag = flag.String("p", "", "port to forward host_port:cont_port")
+var hwFlag = flag.String("hw", "", "mac address of the container (default: derived from name and host id)")
+var netFlag listFlag
+var probeFlag listFlag
+var envFlag listFlag
+var ip6Flag = flag.String("ip6", "", "ipv6 of the container, or auto to derive it from the mac address (needs subnet6 in config)")
+var bFlag = flag.String("b", "", "path to the base container rootfs (default: base from config, /var/lib/lxc/baseCN)")
+var pFlag = flag.String("p", "", "port to forward host_port:cont_port[/udp], :cont_port for a free host port from port_range")
+var proxyFlag = flag.Bool("proxy", false, "forward the port with a userland proxy instead of the firewall (needed for udp)")
 var mFlag = flag.String("m", "", "bind mount of type path_host:cont_host,...")
+var offlineFlag = flag.Bool("offline", false, "never access the network, fail if the base container has to be downloaded")
+var cFlag = flag.String("c", CONFIG_PATH, "path to the host configuration file")
+var rFlag = flag.String("r", "", "root path of the containers (default: root_path from config, /var/lib/thin-lxc)")
+var memFlag = flag.String("mem", "", "memory limit of the container e.g: 512M (default: memory_limit from config)")
+var cpuFlag = flag.Int("cpu", 0, "cpu shares of the container (default: cpu_shares from config)")
+var dnsFlag = flag.String("dns", "", "dns servers of the container ip,ip,... (default: dns from config, gateway)")
+var searchFlag = flag.String("search", "", "dns search domains of the container domain,domain,...")
+var dnsoptFlag = flag.String("dnsopt", "", "resolv.conf options of the container e.g: ndots:2,timeout:1")
+var isolateFlag = flag.Bool("isolate", false, "block traffic between the container and other containers")
+var ingressFlag = flag.String("ingress", POLICY_ALLOW, "allow or deny new connections to the container")
+var egressFlag = flag.String("egress", POLICY_ALLOW, "allow or deny new connections from the container")
+var allowInFlag = flag.String("allow-in", "", "sources allowed despite -isolate / -ingress deny addr[:port[/proto]],...")
+var allowOutFlag = flag.String("allow-out", "", "destinations allowed despite -isolate / -egress deny addr[:port[/proto]],...")
+var tFlag = flag.String("t", "", "template directory for the container, applied after the host one (see README)")
+var paramsFlag = flag.String("params", "", "custom template parameters key=value,key2=value2 (.Params in templates)")
+var timeoutFlag = flag.Duration("timeout", DEFAULT_STATE_TIMEOUT, "how long start and stop wait for the container to be running (and ready) / stopped")
+var userFlag = flag.String("user", "", "exec: user (and group) running the command name[:group], ids or names of the container")
+var cwdFlag = flag.String("cwd", "", "exec: working directory of the command")
+var ttyFlag = flag.Bool("tty", false, "exec: give the command a terminal (needs one)")
+var apiFlag = flag.Bool("api", false, "send the action to thin-lxcd (api_socket in config) instead of running it")
+var fromFlag = flag.String("from", LEGACY_ROOT_PATH, "root path of containers to migrate to the LXC layout")
+
+func init() {
+	flag.Var(&envFlag, "env", "exec: environment variable KEY=value, or KEY for the host value, repeatable")
+	flag.Var(&probeFlag, "probe", "readiness probe checked by start: ip, tcp:port, http:port/path or exec:command, repeatable")
+	flag.Var(&netFlag, "net", "network interface type=veth|macvlan,link=...,ip=...,hw=...,veth=..., repeatable, name=eth0 changes eth0 (type none for no network)")
+}
 
 /*
 Container type + methods
 */
 
 type Container struct {
+	SchemaVersion int
+	CreatedAt time.Time
+	ThinLxcVersion string
+	BaseDigest string
+
 	BaseContainerPath string     
+	RootPath string
 	Path string                  
+	StorageDriver string
 
 	RoLayer string
 	WrLayer string               
 	Rootfs string
 	ConfigPath string
 
+	Distro string
+	Init string
+	NetworkConfig string
+
 	HostName string
 	Ip string
 	Inet string        //if ip, manual else dhcp
+	LeaseIp string     //if dhcp, address reserved in dnsmasq
 	Hwaddr string
 	Name string
 
+	NetworkType string //eth0, veth, macvlan or none
+	Bridge string      //eth0 link, a bridge for veth, an interface for macvlan
+	VethPair string
+	Subnet string
+	Gateway string
+	Ip6 string
+	Subnet6 string
+	Gateway6 string
+	Nameservers []string
+	DnsSearch []string
+	DnsOptions []string
+	Interfaces []*Interface
+
 	Port int
 	HostPort int
+	PortMode string  //nat (firewall, default) or proxy
+	PortProto string //tcp (default) or udp, proxy only
+	ProxyMaxConns int
+
+	Firewall FirewallPolicy
+	FirewallBackend string //iptables or nftables, empty for iptables
 
 	BindMounts map[string]string
+
+	MemoryLimit string
+	CpuShares int
+
+	Probes []*Probe //readiness, checked by start
+
+	TemplateDirs []string
+	Params map[string]string
 }
 
 func newContainer(baseCn string, name string, ports string, hostName string, ip string, bindMounts string) (*Container, error) {
-	path := CONTAINERS_ROOT_PATH + "/" + name
-	if fileExists(path) {
+	if err := validateName(name); err != nil {
+		return nil, err
+	}
+	if _, err := findContainerMetadata(name); err == nil || fileExists(config.RootPath + "/" + name) || fileExists(config.LxcPath + "/" + name) {
 		return nil, errors.New("Container with such name already exists")
 	}
-	hostPort, port := parsePortsArg(ports)
+	hostPort, port, err := parsePortsArg(ports)
+	if err != nil {
+		return nil, err
+	}
 
 	//if ip is defined, use static, else dhcp
 	inet := "dhcp"
@@ -95,29 +174,102 @@ func newContainer(baseCn string, name string, ports string, hostName string, ip
 		hostName = name
 	}
 
+	containers, err := listAllContainers()
+	if err != nil {
+		return nil, err
+	}
+
+	distro := detectDistro(baseCn + "/rootfs")
+	init := detectInit(baseCn + "/rootfs")
+
+	//dnsmasq on the bridge resolves by default
+	nameservers := config.Nameservers
+	if len(nameservers) == 0 {
+		nameservers = []string{config.Gateway}
+	}
+
 	c := &Container{
-		baseCn,                      
-		path,                            
-    
-		path + "/" + name,                
-		path + "/.wlayer",               
-		path + "/" + name + "/rootfs",   
-		path + "/" + name + "/config",      
-
-		hostName,                            
-		ip,
-		inet,
-		randomHwaddr(),                
-		name,                          
-		port,                          
-		hostPort,                      
-		parseBindMountsArg(bindMounts),
+		SchemaVersion: METADATA_VERSION,
+		CreatedAt: time.Now().UTC(),
+		ThinLxcVersion: VERSION,
+		BaseDigest: baseDigest(baseCn),
+
+		BaseContainerPath: baseCn,
+		StorageDriver: config.StorageDriver,
+
+		Distro: distro,
+		Init: init,
+		NetworkConfig: detectNetworkConfig(baseCn + "/rootfs", distro, init),
+
+		HostName: hostName,
+		Ip: ip,
+		Inet: inet,
+		Hwaddr: stableHwaddr(name, hostId(), containers),
+		Name: name,
+
+		NetworkType: NET_TYPE_VETH,
+		Bridge: config.Bridge,
+		Subnet: config.Subnet,
+		Gateway: config.Gateway,
+		Subnet6: config.Subnet6,
+		Gateway6: config.Gateway6,
+		Nameservers: nameservers,
+		DnsSearch: config.DnsSearch,
+		DnsOptions: config.DnsOptions,
+
+		Port: port,
+		HostPort: hostPort,
+
+		BindMounts: parseBindMountsArg(bindMounts),
+
+		MemoryLimit: config.MemoryLimit,
+		CpuShares: config.CpuShares,
+
+		TemplateDirs: []string{config.TemplateDir},
+		Params: make(map[string]string),
 	}
+	c.setLayout(config.RootPath, config.LxcPath)
 	return c, nil
 }
 
+/*
+LXC native layout:
+lxcPath/<name>/       read only layer (overlayfs mount point), seen by lxc-* commands
+	config
+	fstab
+	rootfs/
+rootPath/<name>/      thin-lxc data
+	.wlayer/
+	.metadata.json
+*/
+func (c *Container) setLayout(rootPath string, lxcPath string) {
+	oldRootfs := c.Rootfs
+
+	c.RootPath = rootPath
+	c.Path = rootPath + "/" + c.Name
+	c.RoLayer = lxcPath + "/" + c.Name
+	c.WrLayer = c.Path + "/.wlayer"
+	c.Rootfs = c.RoLayer + "/rootfs"
+	c.ConfigPath = c.RoLayer + "/config"
+
+	//bind mounts targets are saved with the rootfs prefix (see prepareBindMounts)
+	for hostMntPath, contMntPath := range c.BindMounts {
+		if len(oldRootfs) > 0 && strings.HasPrefix(contMntPath, oldRootfs + "/") {
+			c.BindMounts[hostMntPath] = c.Rootfs + strings.TrimPrefix(contMntPath, oldRootfs)
+		}
+	}
+}
+
 func (c *Container) IpConfig() string {
-	return c.Ip + "/24"
+	return c.Ip + "/" + strconv.Itoa(c.PrefixLength())
+}
+
+func (c *Container) PrefixLength() int {
+	return prefixLength(c.Subnet)
+}
+
+func (c *Container) Netmask() string {
+	return netmask(c.Subnet)
 }
 
 func (c *Container) FstabConfig() string {
@@ -128,82 +280,103 @@ func (c *Container) HasStaticIp() bool {
 	return len(c.Ip) > 0
 }
 
+//overlay (mainline) needs an empty work directory on the same filesystem as the upper dir
+func (c *Container) WorkDir() string {
+	return c.Path + "/.work"
+}
+
 func (c *Container) setupOnFS() error {
 	if err := os.MkdirAll(c.RoLayer, 0700); err != nil {
 		return err
 	}
+	if c.StorageDriver == "overlay" {
+		if err := os.MkdirAll(c.WorkDir(), 0700); err != nil {
+			return err
+		}
+	}
 	return os.MkdirAll(c.WrLayer, 0700)
 }
 
 func (c *Container) cleanupFS() error {
-	return os.RemoveAll(c.Path)
-}
-
-func (c *Container) iptablesRuleDo(action string) error {
-	cmd := exec.Command("iptables", "-t", "nat", action, "PREROUTING", "-p", "tcp", "!", "-s", "10.0.3.0/24", "--dport", strconv.Itoa(c.HostPort), "-j", "DNAT", "--to-destination", c.Ip + ":" + strconv.Itoa(c.Port))
-	return runCmdWithDetailedError(cmd)
-}
-
-func (c *Container) iptablesRuleExists() bool {
-	return c.iptablesRuleDo("-C") == nil
-}
-
-func (c *Container) forwardPort() error {
-	if c.Port == 0 && c.HostPort == 0 {
-		return nil
-	}
-	if c.iptablesRuleExists() {
-		return errors.New("Trying to add iptables rule that already exists")
+	//not RemoveAll, if RoLayer is still mounted it would delete the write layer and base content
+	if err := os.Remove(c.RoLayer); err != nil && os.IsNotExist(err) == false {
+		return err
 	}
-	return c.iptablesRuleDo("-A")
+	return os.RemoveAll(c.Path)
 }
 
-func (c *Container) unforwardPort() error {
-	if c.iptablesRuleExists() == false { //rule doesn't exists
-		return nil
-	}
-	return c.iptablesRuleDo("-D")
+var templateFuncs = template.FuncMap{
+	"join": strings.Join,
+	"inc": func(i int) int { return i + 1 },
 }
 
 func (c *Container) executeTemplate(content string, path string) error {
-	tmpl, err := template.New("thin-lxc").Parse(content)
+	tmpl, err := template.New("thin-lxc").Funcs(templateFuncs).Parse(content)
 	if err != nil {
 		return err
 	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	//guest symlinks may be absolute, never write through them (to the host)
+	if info, err := os.Lstat(path); err == nil && info.Mode() & os.ModeSymlink != 0 {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
 	file, err := os.Create(path)
-	defer file.Close()
 	if err != nil {
 		return err
 	}
+	defer file.Close()
 	return tmpl.Execute(file, c)
 }
 
 func (c *Container) configureFiles() error {
-	configs := map[string]string{
-		CONFIG_FILE: c.RoLayer + "/config",
-		INTERFACES_FILE: c.Rootfs + "/etc/network/interfaces",
-		HOSTS_FILE: c.Rootfs + "/etc/hosts",
-		HOSTNAME_FILE: c.Rootfs + "/etc/hostname",
-		SETUP_GATEWAY_FILE: c.Rootfs + "/etc/init/setup-gateway.conf",
-	}
-	for template, path := range configs {
-		if err := c.executeTemplate(template, path); err != nil {
+	userTemplates, err := c.userTemplates()
+	if err != nil {
+		return err
+	}
+	lxcConfig := CONFIG_FILE
+	if t, ok := userTemplates["config"]; ok {
+		lxcConfig = t.content
+	}
+	if err := c.executeTemplate(lxcConfig, c.ConfigPath); err != nil {
+		return err
+	}
+
+	files := c.guestFiles()
+	for path, t := range userTemplates {
+		if path != "config" {
+			files[path] = t.content
+		}
+	}
+	for path, template := range files {
+		if err := c.executeTemplate(template, c.Rootfs + path); err != nil {
 			return err
-		}	
+		}
+		if t, ok := userTemplates[path]; ok {
+			if err := os.Chmod(c.Rootfs + path, t.mode); err != nil {
+				return err
+			}
+		}
 	}
-	return nil
+	return c.enableGuestUnits()
 }
 
 func (c *Container) overlayfsMount() error {
 	mnt := "upperdir=" + c.WrLayer + ",lowerdir=" + c.BaseContainerPath
-	return runCmdWithDetailedError(exec.Command("mount", "-t", "overlayfs", "-o", mnt, "none", c.RoLayer))
+	if c.StorageDriver == "overlay" {
+		mnt += ",workdir=" + c.WorkDir()
+	}
+	return runCmdWithDetailedError(exec.Command("mount", "-t", c.StorageDriver, "-o", mnt, "none", c.RoLayer))
 }
 
 func (c *Container) overlayfsUnmount(tryCount int) error {
 	if err := runCmdWithDetailedError(exec.Command("umount", c.RoLayer)); err != nil {
 		if tryCount >= 0 {
 			time.Sleep(1 * time.Second)
-			c.overlayfsUnmount(tryCount - 1)
+			return c.overlayfsUnmount(tryCount - 1)
 		} else {
 			return err
 		}
@@ -245,6 +418,7 @@ func (c *Container) prepareBindMounts() error {
 }
 
 func (c *Container) marshall() error {
+	c.SchemaVersion = METADATA_VERSION
 	b, err := json.Marshal(c)
 	if err != nil {
 		return err
@@ -252,26 +426,43 @@ func (c *Container) marshall() error {
 	return ioutil.WriteFile(c.Path + "/.metadata.json", b, 0644)
 }
 
+//C_UNKNOWN if the runtime fails, e.g. lxc doesn't know the container
 func (c *Container) state() string {
-	stdout, err := exec.Command("lxc-info", "-n", c.Name).Output()
+	state, err := c.runtime().state(c)
 	if err != nil {
-		log.Println("lxc-info failed", err)
+		log.Println("Unable to get the state of", c.Name, err)
 		return C_UNKNOWN
 	}
-	return strings.Trim(strings.Split(strings.Split(string(stdout), "\n")[0], ":")[1], " ")
+	return state
 }
 
 func (c *Container) isRunning() bool {
 	return c.state() == C_RUNNING
 }
 
+func (c *Container) start() error {
+	return c.runtime().start(c)
+}
+
+func (c *Container) stop() error {
+	return c.runtime().stop(c)
+}
+
 func (c *Container) create() error {
+	if c.HasIp6() {
+		if err := enableIpv6Forwarding(); err != nil {
+			return err
+		}
+	}
 	if err := c.setupOnFS(); err != nil {
 		return err
 	}
 	if err := c.marshall(); err != nil {
 		return err
 	}
+	if err := recordRoot(c.RootPath); err != nil {
+		return err
+	}
 	if err := c.overlayfsMount(); err != nil {
 		return err
 	}
@@ -284,25 +475,88 @@ func (c *Container) create() error {
 	if err := c.forwardPort(); err != nil {
 		return err
 	}
-	return nil
+	return c.applyFirewall()
 }
 
 func (c *Container) destroy() error {
 	if err := c.unforwardPort(); err != nil {
 		return err
 	}
+	if err := c.removeFirewall(); err != nil {
+		return err
+	}
 	if err := c.overlayfsUnmount(5); err != nil {
 		return err
 	}
 	return c.cleanupFS()
 }
 
+func (c *Container) migrateLayout(rootPath string, lxcPath string) error {
+	if c.RootPath == rootPath && c.RoLayer == lxcPath + "/" + c.Name {
+		return nil
+	}
+	if c.isRunning() {
+		return errors.New("Container is running. Stop it before migrating it")
+	}
+	if fileExists(rootPath + "/" + c.Name) || fileExists(lxcPath + "/" + c.Name) {
+		return errors.New("A container with the same name already exists in " + rootPath + " or " + lxcPath)
+	}
+	if c.isMounted() {
+		if err := c.overlayfsUnmount(5); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(rootPath, 0700); err != nil {
+		return err
+	}
+	//mv, the new root may be on another filesystem
+	oldPath, oldRoLayer := c.Path, c.RoLayer
+	if err := runCmdWithDetailedError(exec.Command("mv", oldPath, rootPath + "/" + c.Name)); err != nil {
+		return err
+	}
+	c.setLayout(rootPath, lxcPath)
+	//old mount point moved along with the data
+	os.Remove(c.Path + strings.TrimPrefix(oldRoLayer, oldPath))
+
+	if err := c.setupOnFS(); err != nil {
+		return err
+	}
+	if err := c.marshall(); err != nil {
+		return err
+	}
+	if err := c.overlayfsMount(); err != nil {
+		return err
+	}
+	//only the LXC config references the layout, guest files are left untouched
+	lxcConfig, err := c.lxcConfigTemplate()
+	if err != nil {
+		return err
+	}
+	return c.executeTemplate(lxcConfig, c.ConfigPath)
+}
+
 func (c *Container) reload() error {
+	if c.HasIp6() {
+		if err := enableIpv6Forwarding(); err != nil {
+			return err
+		}
+	}
 	if c.isMounted() == false {
 		if err := c.overlayfsMount(); err != nil {
 			return err
 		}
 	}
+	if err := c.switchFirewall(selectFirewall(config.Firewall)); err != nil {
+		return err
+	}
+	//a DHCP container may have got another address since its rules were added
+	if _, err := c.moveLease(c.resolveAddress()); err != nil {
+		return err
+	}
+	//rules are gone after a reboot
+	if err := c.applyFirewall(); err != nil {
+		return err
+	}
 	return c.forwardPort()
 }
 
@@ -310,15 +564,11 @@ func (c *Container) reload() error {
 Helper methods
 */
 func unmarshall(name string) (*Container, error) {
-	b, err := ioutil.ReadFile(CONTAINERS_ROOT_PATH + "/" + name + "/.metadata.json")
+	metadataPath, err := findContainerMetadata(name)
 	if err != nil {
 		return nil, err
 	}
-	var c Container
-	if err = json.Unmarshal(b, &c); err != nil {
-		return nil, err
-	}
-	return &c, nil
+	return unmarshallFile(metadataPath)
 }
 
 func fileExists(path string) bool {
@@ -326,32 +576,31 @@ func fileExists(path string) bool {
 	return err == nil
 }
 
-func randomHwaddr() string {
-	arr := []string{"00:16:3e"}
-	for i := 0; i < 3; i++ {
-		arr = append(arr, fmt.Sprintf("%0.2x", rand.Intn(256)))
-	}
-	return strings.Join(arr, ":")
-}
-
-func parsePortsArg(ports string) (hostPort int, port int) {
-	hostPort = 0
-	port = 0
-	var err error
+//host_port:cont_port, host_port 0 when assigned later (-p :cont_port)
+func parsePortsArg(ports string) (hostPort int, port int, err error) {
 	if len(ports) == 0 {
-		return
+		return 0, 0, nil
 	}
-	hostPort, err = strconv.Atoi(strings.Split(ports, ":")[0])
-	if err != nil {
-		hostPort = 0
-		return
+	arr := strings.Split(ports, ":")
+	if len(arr) != 2 {
+		return 0, 0, errors.New("Invalid ports " + ports + ", expected host_port:cont_port")
 	}
-	port, err = strconv.Atoi(strings.Split(ports, ":")[1])
-	if err != nil {
-		port = 0;
-		return
+	hostPort, err1 := strconv.Atoi(arr[0])
+	port, err2 := strconv.Atoi(arr[1])
+	if err1 != nil || err2 != nil || hostPort < 0 || hostPort > 65535 || port <= 0 || port > 65535 {
+		return 0, 0, errors.New("Invalid ports " + ports + ", expected host_port:cont_port")
 	}
-	return
+	return hostPort, port, nil
+}
+
+//names end up in paths (root_path, lxc_path) and lxc-* arguments
+var containerName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+func validateName(name string) error {
+	if containerName.MatchString(name) == false {
+		return errors.New("Invalid container name " + strconv.Quote(name) + ", letters, digits, _ . - and not starting with _ . -")
+	}
+	return nil
 }
 
 func parseBindMountsArg(mounts string) (bindMounts map[string]string) {
@@ -377,135 +626,522 @@ func runCmdWithDetailedError(cmd *exec.Cmd) error {
 }
 
 /*
-Usage:
-cs := make(chan string)
-go monitorContainerForState(c, C_RUNNING, cs)
-state := <-cs
+Action methods
 */
-func monitorContainerForState(c *Container, state string, cs chan string) {
-	curState := c.state()
-	if curState == state {
-		if state == C_RUNNING {
-			time.Sleep(5 * time.Second) //wait extra time to make sure network is up
-		}
-		cs <- curState
-		close(cs)
-		return
+
+//options of a create, from the flags or an API request. Empty values fall back to the host configuration
+type createOptions struct {
+	Name string
+	HostName string
+	Ip string
+	Hwaddr string
+	Ip6 string
+	Networks []string
+	Base string
+	Ports string //host_port:cont_port[/udp], :cont_port for a free host port
+	Proxy bool
+	BindMounts string
+	MemoryLimit string
+	CpuShares int
+	Nameservers []string
+	DnsSearch []string
+	DnsOptions []string
+	Firewall FirewallPolicy
+	Probes []string
+	TemplateDir string
+	Params string
+}
+
+//flags explicitly given, others are left to the configuration (of thin-lxcd with -api)
+func createOptionsFromFlags() createOptions {
+	opts := createOptions{
+		Name: *nFlag,
+		HostName: *hnFlag,
+		Ip: *ipFlag,
+		Hwaddr: *hwFlag,
+		Ip6: *ip6Flag,
+		Networks: netFlag,
+		Ports: *pFlag,
+		Proxy: *proxyFlag,
+		BindMounts: *mFlag,
+		Firewall: FirewallPolicy{*isolateFlag, *ingressFlag, *egressFlag, splitList(*allowInFlag), splitList(*allowOutFlag)},
+		Probes: probeFlag,
+		TemplateDir: *tFlag,
+		Params: *paramsFlag,
 	}
-	time.Sleep(500 * time.Millisecond)
-	monitorContainerForState(c, state, cs)
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "b":
+			opts.Base = *bFlag
+		case "mem":
+			opts.MemoryLimit = *memFlag
+		case "cpu":
+			opts.CpuShares = *cpuFlag
+		case "dns":
+			opts.Nameservers = splitList(*dnsFlag)
+		case "search":
+			opts.DnsSearch = splitList(*searchFlag)
+		case "dnsopt":
+			opts.DnsOptions = splitList(*dnsoptFlag)
+		}
+	})
+	return opts
 }
 
-func downloadFromUrl(url string, path string, fileName string) error {
-	if  err := os.MkdirAll(path, 0700); err != nil {
+//checked before anything is done, a base download included
+func (opts createOptions) validate() error {
+	if err := validateName(opts.Name); err != nil {
 		return err
 	}
-	output, err := os.Create(path + "/" + fileName)
+	ports, _, err := splitPortProto(opts.Ports)
 	if err != nil {
 		return err
 	}
-	defer output.Close()
-
-	resp, err := http.Get(url)
-	if err != nil {
-		return err
+	if strings.HasPrefix(ports, ":") {
+		ports = "0" + ports
 	}
-	defer resp.Body.Close()
-
-	_, err = io.Copy(output, resp.Body)
+	_, _, err = parsePortsArg(ports)
 	return err
 }
 
-func downloadBaseCN() error {
-	if fileExists(BASE_CN_PATH + "/baseCN/rootfs") {
-		return nil
+func createContainer(opts createOptions) (*Container, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
 	}
-	fmt.Print("First time thin-lxc, downloading base container ... ")
-	//download tar
-	if err := downloadFromUrl(BASE_CN_URL, BASE_CN_PATH, "baseCN.tar.gz"); err != nil {
-		return err
+	base := opts.Base
+	if len(base) == 0 {
+		base = config.BaseContainer
+	}
+	if err := ensureBaseCN(base); err != nil {
+		return nil, err
 	}
-	fmt.Println("Done")
-	fmt.Print("Checking base container integrity ... ")
-	//check md5
-	resp, err := http.Get(BASE_CN_MD5_URL)
+	ports, proto, err := splitPortProto(opts.Ports)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	//-p :port, host port assigned once the other containers are known
+	autoPort := strings.HasPrefix(ports, ":")
+	if autoPort {
+		ports = "0" + ports
 	}
-	defer resp.Body.Close()
-	expectedSum, err := ioutil.ReadAll(resp.Body)
-	f, err := os.Open(BASE_CN_PATH + "/baseCN.tar.gz")
+	c, err := newContainer(base, opts.Name, ports, opts.HostName, opts.Ip, opts.BindMounts)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer f.Close()
-	md5 := md5.New()
-	io.Copy(md5, f)
-	sum := fmt.Sprintf("%x", md5.Sum(nil))
-	if strings.Replace(string(expectedSum), "\n", "", -1) != sum {
-		return errors.New("MD5 sum check failed " + string(expectedSum) + " != " + sum)
+	if len(opts.MemoryLimit) > 0 {
+		c.MemoryLimit = opts.MemoryLimit
 	}
-	fmt.Println("Done")
-
-	//untar
-	fmt.Print("Extracting base container to ", BASE_CN_PATH, " ... ")
-	untar := exec.Command("sudo", "tar", "-C", BASE_CN_PATH, "-xf", BASE_CN_PATH + "/baseCN.tar.gz")
-	err = runCmdWithDetailedError(untar)
+	if opts.CpuShares > 0 {
+		c.CpuShares = opts.CpuShares
+	}
+	if len(opts.Nameservers) > 0 {
+		c.Nameservers = opts.Nameservers
+	}
+	if len(opts.DnsSearch) > 0 {
+		c.DnsSearch = opts.DnsSearch
+	}
+	if len(opts.DnsOptions) > 0 {
+		c.DnsOptions = opts.DnsOptions
+	}
+	if err := c.setPortMode(opts.Proxy, proto, config.ProxyMaxConns); err != nil {
+		return nil, err
+	}
+	if len(opts.TemplateDir) > 0 {
+		if fileExists(opts.TemplateDir) == false {
+			return nil, errors.New("Template directory " + opts.TemplateDir + " doesn't exists")
+		}
+		c.TemplateDirs = append(c.TemplateDirs, opts.TemplateDir)
+	}
+	if c.Params, err = parseParamsArg(opts.Params); err != nil {
+		return nil, err
+	}
+	containers, err := listAllContainers()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if autoPort {
+		err = c.assignHostPort(containers)
+	} else {
+		err = c.checkHostPort(containers)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(opts.Hwaddr) > 0 {
+		if err := c.setHwaddr(opts.Hwaddr, containers); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.setNetworks(opts.Networks, containers); err != nil {
+		return nil, err
 	}
-	fmt.Println("Done")
+	c.FirewallBackend = selectFirewall(config.Firewall)
+	policy := opts.Firewall
+	if len(policy.Ingress) == 0 {
+		policy.Ingress = POLICY_ALLOW
+	}
+	if len(policy.Egress) == 0 {
+		policy.Egress = POLICY_ALLOW
+	}
+	if err := c.setFirewallPolicy(policy); err != nil {
+		return nil, err
+	}
+	if err := c.setProbes(opts.Probes); err != nil {
+		return nil, err
+	}
+	//DHCP containers get their address now, firewall rules need it
+	if c.HasVeth() && c.HasStaticIp() == false {
+		if err := c.reserveLease(containers, readLeases(config.DnsmasqLeases)); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.assignIp6(opts.Ip6, containers); err != nil {
+		return nil, err
+	}
+	if err := c.create(); err != nil {
+		return nil, fmt.Errorf("Unable to create container %v", err)
+	}
+	syncHosts()
+	return c, nil
+}
+
+func destroyContainer(c *Container) error {
+	if c.isRunning() {
+		return errors.New("Container is running. Stop it before destroying it")
+	}
+	if err := c.destroy(); err != nil {
+		return fmt.Errorf("Unable to destroy container %v", err)
+	}
+	syncHosts()
 	return nil
 }
 
-/*
-Action methods
-*/
+func reloadContainers(containers []*Container) {
+	for _, c := range containers {
+		if err := c.reload(); err != nil {
+			log.Println("Unable to reload", c.Name, err)
+		}
+	}
+	syncHosts()
+}
 
 func create() {
-	c, err := newContainer(*bFlag, *nFlag, *pFlag, *hnFlag, *ipFlag, *mFlag)
+	opts := createOptionsFromFlags()
+	var c *Container
+	var err error
+	if *apiFlag {
+		c, err = newApiClient(config.ApiSocket).create(opts)
+	} else {
+		c, err = createContainer(opts)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
-	if err := c.create(); err != nil {
-		log.Fatal("Unable to create container", err)
+	if strings.HasPrefix(opts.Ports, ":") {
+		fmt.Println("Port", c.Port, "published on host port", c.HostPort)
 	}
-
-	fmt.Println("Container created start using: \"lxc-start -n", c.Name,"-f", c.ConfigPath, "-d\"")
+	fmt.Println("Container created start using: \"lxc-start -n", c.Name, "-d\"")
 }
 
 func destroy() {
+	if *apiFlag {
+		if err := newApiClient(config.ApiSocket).destroy(*nFlag); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	c, err := unmarshall(*nFlag)
+	if err != nil {
+		log.Fatal("Unable to unmarchall container metadata", err)
+	}
+	if err := destroyContainer(c); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func start() {
+	if *apiFlag {
+		if err := newApiClient(config.ApiSocket).start(*nFlag, *timeoutFlag); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	c, err := unmarshall(*nFlag)
 	if err != nil {
 		log.Fatal("Unable to unmarchall container metadata", err)
 	}
 	if c.isRunning() {
-		log.Fatal("Container is running. Stop it before destroying it")
+		log.Fatal("Container is already running")
 	}
-	if err := c.destroy(); err != nil {
-		log.Fatal("Unable to destroy container", err)
+	ctx, cancel := context.WithTimeout(context.Background(), *timeoutFlag)
+	defer cancel()
+	watcher := watchStates(ctx)
+	if err := c.start(); err != nil {
+		log.Fatal("Unable to start container", err)
+	}
+	if _, err := c.waitForState(ctx, watcher, C_RUNNING); err != nil {
+		log.Fatal(err)
+	}
+	if err := c.waitReady(ctx); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func stop() {
+	if *apiFlag {
+		if err := newApiClient(config.ApiSocket).stop(*nFlag, *timeoutFlag); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	c, err := unmarshall(*nFlag)
+	if err != nil {
+		log.Fatal("Unable to unmarchall container metadata", err)
+	}
+	if c.isRunning() == false {
+		log.Fatal("Container is not running")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *timeoutFlag)
+	defer cancel()
+	watcher := watchStates(ctx)
+	if err := c.stop(); err != nil {
+		log.Fatal("Unable to stop container", err)
+	}
+	if _, err := c.waitForState(ctx, watcher, C_STOPPED); err != nil {
+		log.Fatal(err)
+	}
+}
+
+//state changes, of every container or of -n, until interrupted
+func events() {
+	var events <-chan stateEvent
+	//lxc-monitor missing or exited, without -api
+	monitorErr := make(chan error, 1)
+	if *apiFlag {
+		var err error
+		if events, err = newApiClient(config.ApiSocket).events(*nFlag); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		w := newStateWatcher()
+		events = w.subscribe()
+		go func() {
+			monitorErr <- w.monitor(context.Background(), config.LxcPath)
+		}()
+	}
+	printEvent := func(e stateEvent) {
+		if len(*nFlag) == 0 || e.Name == *nFlag {
+			fmt.Println(e.Time.Format(time.RFC3339), e.Name, e.State)
+		}
+	}
+	for {
+		select {
+		case e, ok := <-events:
+			if ok == false {
+				log.Fatal("Event stream closed")
+			}
+			printEvent(e)
+		case err := <-monitorErr:
+			//published before lxc-monitor exited
+			for len(events) > 0 {
+				printEvent(<-events)
+			}
+			log.Fatal("Unable to watch state changes: ", err)
+		}
+	}
+}
+
+func list() {
+	var infos []*containerInfo
+	if *apiFlag {
+		var err error
+		if infos, err = newApiClient(config.ApiSocket).list(); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		containers, err := listAllContainers()
+		if err != nil {
+			log.Fatal(err)
+		}
+		warnLegacyContainers(containers)
+		infos = containerInfos(containers)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSTATE\tADDRESS\tPORT")
+	for _, info := range infos {
+		port := ""
+		if info.HostPort != 0 {
+			port = strconv.Itoa(info.HostPort) + "->" + strconv.Itoa(info.Port) + "/" + info.portProto()
+		}
+		fmt.Fprintln(w, info.Name + "\t" + info.State + "\t" + info.Address() + "\t" + port)
+	}
+	w.Flush()
+}
+
+func inspect() {
+	var info *containerInfo
+	if *apiFlag {
+		var err error
+		if info, err = newApiClient(config.ApiSocket).inspect(*nFlag); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		c, err := unmarshall(*nFlag)
+		if err != nil {
+			log.Fatal("Unable to unmarchall container metadata", err)
+		}
+		info = &containerInfo{c, c.state()}
+	}
+	b, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(string(b))
+}
+
+//thin-lxc -a exec -n NAME -- cmd args, exits with the exit code of the command (see exec.go)
+func execute() {
+	c, err := unmarshall(*nFlag)
+	if err != nil {
+		log.Println("Unable to unmarchall container metadata", err)
+		os.Exit(EXEC_FAILED)
+	}
+	opts := attachOptions{Cwd: *cwdFlag}
+	if opts.Env, err = parseEnvArgs(envFlag); err == nil {
+		err = c.setUser(&opts, *userFlag)
+	}
+	if err != nil {
+		log.Println(err)
+		os.Exit(EXEC_FAILED)
+	}
+	code, err := c.exec(flag.Args(), opts, *ttyFlag)
+	if err != nil {
+		log.Println(err)
+	}
+	os.Exit(code)
+}
+
+//thin-lxcd, see daemon.go
+func daemon() {
+	if err := serveApi(config.ApiSocket); err != nil {
+		log.Fatal(err)
 	}
 }
 
 func reload() {
+	if *apiFlag {
+		if err := newApiClient(config.ApiSocket).reload(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	//after a reboot, overlayfs mount and iptables rules will be deleted, reload will reset everything
-	dirs, err := ioutil.ReadDir(CONTAINERS_ROOT_PATH)
+	containers, err := listAllContainers()
+	if err != nil {
+		log.Fatal(err)
+	}
+	warnLegacyContainers(containers)
+	reloadContainers(containers)
+}
+
+func pull() {
+	if fileExists(config.ImagePath + "/baseCN/rootfs") {
+		fmt.Println("Base container already present in", config.ImagePath + "/baseCN")
+		return
+	}
+	if err := downloadBaseCN(); err != nil {
+		log.Fatal("Something went wrong while downloading base container ", err)
+	}
+}
+
+//remove every firewall rule thin-lxc added, with every backend, reload puts them back
+func flush() {
+	containers, err := listAllContainers()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for name, backend := range firewallBackends {
+		if err := backend.flush(containers); err != nil {
+			log.Fatal("Unable to flush ", name, " rules ", err)
+		}
+	}
+	//the loopback drops are gone with the rules
+	bridges := map[string]bool{}
+	for _, c := range containers {
+		if len(c.Bridge) == 0 || bridges[c.Bridge] {
+			continue
+		}
+		bridges[c.Bridge] = true
+		if err := disableRouteLocalnet(c.Bridge); err != nil {
+			log.Println("Unable to turn route_localnet off on", c.Bridge, err)
+		}
+	}
+}
+
+//dnsmasq dhcp-script: lease add|old|del hwaddr ip [hostname], without arguments checks every container
+func lease() {
+	containers, err := listAllContainers()
+	if err != nil {
+		log.Fatal(err)
+	}
+	args := flag.Args()
+	if len(args) == 0 {
+		for _, c := range containers {
+			if err := c.syncLease(c.resolveAddress()); err != nil {
+				log.Println("Unable to update the rules of", c.Name, err)
+			}
+		}
+		syncHosts()
+		return
+	}
+	//del: the reservation is kept for the next start
+	if len(args) < 3 || (args[0] != "add" && args[0] != "old") {
+		return
+	}
+	c := findByHwaddr(containers, args[1])
+	if c == nil {
+		return
+	}
+	if err := c.syncLease(args[2]); err != nil {
+		log.Fatal("Unable to update the rules of ", c.Name, " ", err)
+	}
+	syncHosts()
+}
+
+//started by create and reload for -proxy containers, restarts the proxy until stopped
+func proxy() {
+	c, err := unmarshall(*nFlag)
+	if err != nil {
+		log.Fatal("Unable to unmarchall container metadata", err)
+	}
+	if err := superviseProxy(c.Name, c.runProxy); err != nil {
+		log.Fatal(err)
+	}
+}
+
+//move containers from the legacy layout (<from>/<name>/<name> read only layer) to the LXC native one
+func migrate() {
+	dirs, err := ioutil.ReadDir(*fromFlag)
 	if err != nil {
 		log.Fatal(err)
 	}
 	for i := range dirs {
-		dir := dirs[i]
-		if fileExists(CONTAINERS_ROOT_PATH + "/" + dir.Name() + "/.metadata.json") == false {
+		metadataPath := *fromFlag + "/" + dirs[i].Name() + "/.metadata.json"
+		if fileExists(metadataPath) == false {
 			continue
 		}
-		c, err := unmarshall(dir.Name())
+		c, err := unmarshallFile(metadataPath)
 		if err != nil {
-			log.Println("Unable to unmarshall", c.Name)
+			log.Println("Unable to unmarshall", dirs[i].Name(), err)
+			continue
 		}
-		if err := c.reload(); err != nil {
-			log.Println("Unable to reload", c.Name)
+		if err := c.migrateLayout(config.RootPath, config.LxcPath); err != nil {
+			log.Println("Unable to migrate", c.Name, err)
+			continue
 		}
+		fmt.Println("Migrated", c.Name, "start using: \"lxc-start -n", c.Name, "-d\"")
 	}
+	os.Remove(*fromFlag) //only if empty
 }
 
 /*
@@ -514,23 +1150,54 @@ main method
 
 func main() {
 	flag.Parse()
+	if filepath.Base(os.Args[0]) == "thin-lxcd" {
+		*aFlag = "daemon"
+	}
 	if *vFlag {
 		fmt.Println(VERSION)
 		return
 	}
 
-	err := downloadBaseCN()
+	cfg, err := loadConfig(*cFlag, *cFlag != CONFIG_PATH)
 	if err != nil {
-		log.Fatal("Something went wrong while downloading base container", err)
+		log.Fatal("Unable to load configuration ", err)
+	}
+	cfg.applyFlags()
+	if err := cfg.validate(); err != nil {
+		log.Fatal("Invalid option ", err)
 	}
+	config = cfg
 
 	if *aFlag == "create" {
-		rand.Seed(time.Now().Unix())
 		create()
 	} else if *aFlag == "destroy" {
 		destroy()
+	} else if *aFlag == "start" {
+		start()
+	} else if *aFlag == "stop" {
+		stop()
+	} else if *aFlag == "list" {
+		list()
+	} else if *aFlag == "inspect" {
+		inspect()
+	} else if *aFlag == "events" {
+		events()
+	} else if *aFlag == "exec" {
+		execute()
+	} else if *aFlag == "daemon" {
+		daemon()
 	} else if *aFlag == "reload" {
 		reload()
+	} else if *aFlag == "pull" {
+		pull()
+	} else if *aFlag == "migrate" {
+		migrate()
+	} else if *aFlag == "flush" {
+		flush()
+	} else if *aFlag == "proxy" {
+		proxy()
+	} else if *aFlag == "lease" {
+		lease()
 	} else {
 		log.Fatal("Unknown action ", *aFlag)
 	}
@@ -542,14 +1209,45 @@ template constants
 
 // On host: /containers/name/image/config
 const CONFIG_FILE = `
-lxc.network.type=veth
-lxc.network.link=lxcbr0
+lxc.utsname = {{.HostName}}
+{{if .HasNetwork}}
+lxc.network.type={{.NetworkType}}
+lxc.network.link={{.Bridge}}
+{{if eq .NetworkType "macvlan"}}
+lxc.network.macvlan.mode = bridge
+{{end}}
+{{if .VethPair}}
+lxc.network.veth.pair = {{.VethPair}}
+{{end}}
 lxc.network.flags=up
+lxc.network.name = eth0
 lxc.network.hwaddr = {{.Hwaddr}}
-lxc.utsname = {{.HostName}}
 {{if .HasStaticIp}}
 	lxc.network.ipv4 = {{.IpConfig}}
 {{end}}
+{{if .HasIp6}}
+lxc.network.ipv6 = {{.Ip6Config}}
+lxc.network.ipv6.gateway = {{.Gateway6}}
+{{end}}
+{{else}}
+lxc.network.type = empty
+{{end}}
+{{range .Interfaces}}
+lxc.network.type = {{.Type}}
+lxc.network.link = {{.Link}}
+{{if eq .Type "macvlan"}}
+lxc.network.macvlan.mode = bridge
+{{end}}
+{{if .VethPair}}
+lxc.network.veth.pair = {{.VethPair}}
+{{end}}
+lxc.network.flags = up
+lxc.network.name = {{.Name}}
+lxc.network.hwaddr = {{.Hwaddr}}
+{{if .HasStaticIp}}
+	lxc.network.ipv4 = {{.IpConfig}}
+{{end}}
+{{end}}
 
 lxc.devttydir = lxc
 lxc.tty = 4
@@ -557,6 +1255,12 @@ lxc.pts = 1024
 lxc.rootfs = {{.Rootfs}}
 lxc.mount  = {{.FstabConfig}}
 lxc.arch = amd64
+{{if .MemoryLimit}}
+lxc.cgroup.memory.limit_in_bytes = {{.MemoryLimit}}
+{{end}}
+{{if .CpuShares}}
+lxc.cgroup.cpu.shares = {{.CpuShares}}
+{{end}}
 lxc.cap.drop = sys_module mac_admin
 lxc.pivotdir = lxc_putold
 
@@ -601,13 +1305,37 @@ lxc.mount.entry = {{$key}} {{$value}} none bind,rw 0 0
 const INTERFACES_FILE = `
 auto lo
 iface lo inet loopback
+{{if .HasNetwork}}
 auto eth0
 iface eth0 inet {{.Inet}}
+{{if .Nameservers}}
+	dns-nameservers {{join .Nameservers " "}}
+{{end}}
+{{if .DnsSearch}}
+	dns-search {{join .DnsSearch " "}}
+{{end}}
+{{if .DnsOptions}}
+	dns-options {{join .DnsOptions " "}}
+{{end}}
+{{if .HasIp6}}
+iface eth0 inet6 manual
+{{end}}
+{{end}}
+{{range .Interfaces}}
+auto {{.Name}}
+iface {{.Name}} inet {{.Inet}}
+{{end}}
 `
 
 //In container: /etc/hosts
 const HOSTS_FILE = `
 127.0.0.1 localhost {{.HostName}}
+{{if .HostHostName}}
+{{.Gateway}} {{.HostHostName}}
+{{end}}
+{{range .Peers}}
+{{.Ip}} {{join .Names " "}}
+{{end}}
 `
 
 //In container: /etc/hostname
@@ -620,7 +1348,10 @@ const SETUP_GATEWAY_FILE = `
 description "setup gateway"
 start on startup
 script
-route add -net default gw 10.0.3.1
+route add -net default gw {{.Gateway}}
+{{if .HasIp6}}
+ip -6 route replace default via {{.Gateway6}}
+{{end}}
 end script
 `
 
@@ -1,6 +1,7 @@
 package main
 
 import(
+	"context"
 	"testing"
 	"reflect"
 	"os"
@@ -62,14 +63,19 @@ Individual method test
 
 func Test_parsePortsArg(t *testing.T) {
 	fmt.Print("Testing port option parsing ... ")
-	hostPort, port := parsePortsArg("1800:6777")
-	if hostPort != 1800 || port != 6777 {
+	hostPort, port, err := parsePortsArg("1800:6777")
+	if hostPort != 1800 || port != 6777 || err != nil {
 		failTest(t, "ports parsing failed")
 	}
-	hostPort, port = parsePortsArg("hello there")
-	if hostPort != 0 || port != 0 {
+	hostPort, port, err = parsePortsArg("hello there")
+	if hostPort != 0 || port != 0 || err == nil {
 		failTest(t, "ports parsing failed")
 	}
+	for _, ports := range []string{"8080", "8080:", ":80", "1:2:3", "8080:70000"} {
+		if _, _, err := parsePortsArg(ports); err == nil {
+			failTest(t, "invalid ports should fail", ports)
+		}
+	}
 	fmt.Println("OK")
 }
 
@@ -82,6 +88,22 @@ func Test_parseBindMountsArg(t *testing.T) {
 	fmt.Println("OK")
 }
 
+func Test_setLayout(t *testing.T) {
+	fmt.Print("Testing LXC native layout ... ")
+	c := &Container{Name: "web", Rootfs: "/containers/web/web/rootfs", BindMounts: map[string]string{"/app": "/containers/web/web/rootfs/app"}}
+	c.setLayout("/var/lib/thin-lxc", "/var/lib/lxc")
+	if c.Path != "/var/lib/thin-lxc/web" || c.WrLayer != "/var/lib/thin-lxc/web/.wlayer" {
+		failTest(t, "thin-lxc data not in root path", c.Path, c.WrLayer)
+	}
+	if c.RoLayer != "/var/lib/lxc/web" || c.ConfigPath != "/var/lib/lxc/web/config" || c.Rootfs != "/var/lib/lxc/web/rootfs" {
+		failTest(t, "read only layer not in lxc path", c.RoLayer, c.ConfigPath, c.Rootfs)
+	}
+	if c.BindMounts["/app"] != "/var/lib/lxc/web/rootfs/app" {
+		failTest(t, "bind mount not moved to the new rootfs", c.BindMounts["/app"])
+	}
+	fmt.Println("OK")
+}
+
 func Test_marshalling(t *testing.T) {
 	fmt.Print("Testing container metadata marshalling/unmarshalling ... ")
 	for i := range containers {
@@ -145,30 +167,24 @@ func Test_containerStateMonitoring(t *testing.T) {
 		failTest(t, "Failed to create container", err)
 	}
 	
-	cs := make(chan string)
-	go monitorContainerForState(&c, C_STOPPED, cs)
-	state := <-cs
+	state := waitState(&c, C_STOPPED, t)
 	if state != C_STOPPED {
 		failTest(t, "Expected", C_STOPPED, "got", state)
 	}
 
-	cs = make(chan string)
-	go monitorContainerForState(&c, C_RUNNING, cs)
 	if err := c.start(); err != nil {
 		failTest(t, "Failed to start container", err)
 	}
-	state = <-cs
+	state = waitState(&c, C_RUNNING, t)
 	if state != C_RUNNING {
 		failTest(t, "Excepted", C_RUNNING, "got", state)
 	}
 
-	cs = make(chan string)
-	go monitorContainerForState(&c, C_STOPPED, cs)
 	if err := c.stop(); err != nil {
 		failTest(t, "Failed to stop container", err)
 	}
+	state = waitState(&c, C_STOPPED, t)
 	c.destroy()
-	state = <-cs
 	if state != C_STOPPED {
 		failTest(t, "Excepted", C_STOPPED, "got", state)
 	}
@@ -189,9 +205,7 @@ func Test_create(t *testing.T) {
 		if err := c.start(); err != nil {
 			failTest(t, "Unable to start container", err)
 		}
-		cs := make(chan string)
-		go monitorContainerForState(&c, C_RUNNING, cs)
-		<-cs
+		waitState(&c, C_RUNNING, t)
 
 		c.checkInternal(i == 2, t)
 		
@@ -217,9 +231,7 @@ func Test_reload(t *testing.T) {
 		if err := c.start(); err != nil {
 			failTest(t, "Failed to start container", err)
 		}
-		cs := make(chan string)
-		go monitorContainerForState(&c, C_RUNNING, cs)
-		<-cs
+		waitState(&c, C_RUNNING, t)
 	}
 
 	for i := range containers {
@@ -245,9 +257,7 @@ func Test_reload(t *testing.T) {
 		if err := c.start(); err != nil {
 			failTest(t, "Failed to restart container after reload", err)
 		}
-		cs := make(chan string)
-		go monitorContainerForState(&c, C_RUNNING, cs)
-		<-cs
+		waitState(&c, C_RUNNING, t)
 
 		c.checkInternal(i == 2, t)
 
@@ -266,12 +276,20 @@ func Test_reload(t *testing.T) {
 /*
 	Helper
 */
-func (c *Container) start() error {
-	return runCmdWithDetailedError(exec.Command("lxc-start", "-n", c.Name, "-f", c.ConfigPath, "-d"))
-}
-
-func (c *Container) stop() error {
-	return runCmdWithDetailedError(exec.Command("lxc-stop", "-n", c.Name))
+//running containers are waited until they have an address
+func waitState(c *Container, state string, t *testing.T) string {
+	ctx, cancel := context.WithTimeout(context.Background(), DEFAULT_STATE_TIMEOUT)
+	defer cancel()
+	current, err := c.waitForState(ctx, watchStates(ctx), state)
+	if err != nil {
+		failTest(t, "Container state", err)
+	}
+	if current == C_RUNNING {
+		if err := (&Probe{Type: PROBE_IP}).wait(ctx, c); err != nil {
+			failTest(t, "Container network", err)
+		}
+	}
+	return current
 }
 
 func (c *Container) checkInternal(testBindMount bool, t *testing.T) {
@@ -307,9 +325,9 @@ func cleanup() {
 	for i := range containers {
 		c := containers[i]
 		c.stop();
-		cs := make(chan string)
-		go monitorContainerForState(&c, C_STOPPED, cs)
-		<-cs
+		ctx, cancel := context.WithTimeout(context.Background(), DEFAULT_STATE_TIMEOUT)
+		c.waitForState(ctx, watchStates(ctx), C_STOPPED)
+		cancel()
 		c.destroy() //destroy ignoring errors
 	}
 	fmt.Println("OK")